@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/common/model"
+)
+
+// Per topic, bucketAlertGroups maps the group key of every recently stored
+// Alertmanager notification to the time it was last seen, the index range of
+// the messages it was stored as, and its dedup hash.
+const bucketAlertGroups = "alertGroups"
+
+// An AlertmanagerConfig enables special handling of topics that receive
+// Alertmanager webhook notifications.
+type AlertmanagerConfig struct {
+	// If DedupWindow is set, a notification that is identical to the last one
+	// stored for the same alert group within the window is not stored again.
+	// Instead, the stored message's repeat counter and last-seen time are
+	// updated.
+	DedupWindow Duration `json:"dedupWindow,omitempty"`
+	// If SplitAlerts is set, each alert of a notification is stored as its own
+	// message, along with the notification's group-level fields.
+	SplitAlerts bool `json:"splitAlerts,omitempty"`
+}
+
+// An alertmanagerNotification is the payload of an Alertmanager webhook
+// notification.
+type alertmanagerNotification struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+// An alertmanagerAlert is a single alert within an Alertmanager notification.
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// A splitAlert is the data of a message that holds a single alert of a split
+// notification.
+type splitAlert struct {
+	alertmanagerAlert
+	Fingerprint  string            `json:"fingerprint"`
+	Receiver     string            `json:"receiver"`
+	ExternalURL  string            `json:"externalURL"`
+	CommonLabels map[string]string `json:"commonLabels"`
+}
+
+// parseAlertmanagerNotification interprets decoded message data as an
+// Alertmanager notification. It returns false if the data doesn't look like
+// one.
+func parseAlertmanagerNotification(data interface{}) (*alertmanagerNotification, bool) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, false
+	}
+	var n alertmanagerNotification
+	if err := json.Unmarshal(buf, &n); err != nil || n.GroupKey == "" {
+		return nil, false
+	}
+	return &n, true
+}
+
+// alertFingerprint identifies an alert by its labels, the same way Prometheus
+// and Alertmanager do.
+func alertFingerprint(labels map[string]string) string {
+	ls := make(model.LabelSet, len(labels))
+	for ln, lv := range labels {
+		ls[model.LabelName(ln)] = model.LabelValue(lv)
+	}
+	return ls.Fingerprint().String()
+}
+
+// splitAlerts returns the data of the messages to store the notification's
+// alerts as.
+func (n *alertmanagerNotification) splitAlerts() []interface{} {
+	alerts := make([]interface{}, 0, len(n.Alerts))
+	for _, a := range n.Alerts {
+		alerts = append(alerts, splitAlert{
+			alertmanagerAlert: a,
+			Fingerprint:       alertFingerprint(a.Labels),
+			Receiver:          n.Receiver,
+			ExternalURL:       n.ExternalURL,
+			CommonLabels:      n.CommonLabels,
+		})
+	}
+	return alerts
+}
+
+// dedupHash identifies the state of a notification's alert group: its group key
+// and the fingerprints and statuses of all alerts in it, regardless of order.
+func (n *alertmanagerNotification) dedupHash() []byte {
+	states := make([]string, 0, len(n.Alerts))
+	for _, a := range n.Alerts {
+		states = append(states, alertFingerprint(a.Labels)+":"+a.Status)
+	}
+	sort.Strings(states)
+
+	h := sha256.New()
+	h.Write([]byte(n.GroupKey))
+	for _, s := range states {
+		h.Write([]byte{0})
+		h.Write([]byte(s))
+	}
+	return h.Sum(nil)
+}
+
+// repeatNotification looks for the messages that store a notification
+// identical to the given one and were last seen within the window. If there
+// are any, it marks them as seen again and returns them. Otherwise, it returns
+// nil.
+func repeatNotification(tx *bolt.Tx, b *bolt.Bucket, topic []byte, n *alertmanagerNotification, window time.Duration, now time.Time) ([]Message, error) {
+	gb := tx.Bucket([]byte(bucketAlertGroups)).Bucket(topic)
+	if gb == nil {
+		return nil, nil
+	}
+	v := gb.Get([]byte(n.GroupKey))
+	if v == nil {
+		return nil, nil
+	}
+	lastSeen := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	if lastSeen.Before(now.Add(-window)) || !bytes.Equal(v[24:], n.dedupHash()) {
+		return nil, nil
+	}
+
+	first, last := binary.BigEndian.Uint64(v[8:]), binary.BigEndian.Uint64(v[16:])
+	stats := getTopicStats(tx, topic)
+	var msgs []Message
+	for idx := first; idx <= last; idx++ {
+		old := b.Get(keyFromIndex(idx))
+		if old == nil {
+			// The message has been purged in the meantime.
+			continue
+		}
+		oldSize := uint64(len(old))
+		var msg Message
+		if err := json.Unmarshal(old, &msg); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		if msg.Deleted {
+			continue
+		}
+
+		msg.Repeats++
+		msg.LastSeen = &now
+		buf, err := json.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling message: %v", err)
+		}
+		if err := b.Put(keyFromIndex(idx), buf); err != nil {
+			return nil, fmt.Errorf("error updating message: %v", err)
+		}
+		stats.bytes = stats.bytes - oldSize + uint64(len(buf))
+		msgs = append(msgs, msg)
+	}
+	if msgs == nil {
+		return nil, nil
+	}
+
+	if err := putTopicStats(tx, topic, stats); err != nil {
+		return nil, err
+	}
+	return msgs, putAlertGroup(tx, topic, n, msgs, now)
+}
+
+// putAlertGroup records that a notification has been stored as the given
+// messages and was last seen at the given time.
+func putAlertGroup(tx *bolt.Tx, topic []byte, n *alertmanagerNotification, msgs []Message, lastSeen time.Time) error {
+	gb, err := tx.Bucket([]byte(bucketAlertGroups)).CreateBucketIfNotExists(topic)
+	if err != nil {
+		return fmt.Errorf("error creating alert group bucket for topic %q: %v", topic, err)
+	}
+	v := make([]byte, 24, 24+sha256.Size)
+	binary.BigEndian.PutUint64(v, uint64(lastSeen.UnixNano()))
+	binary.BigEndian.PutUint64(v[8:], msgs[0].Index)
+	binary.BigEndian.PutUint64(v[16:], msgs[len(msgs)-1].Index)
+	v = append(v, n.dedupHash()...)
+	if err := gb.Put([]byte(n.GroupKey), v); err != nil {
+		return fmt.Errorf("error storing alert group: %v", err)
+	}
+	return nil
+}
+
+// gcAlertGroups deletes up to limit alert group records whose dedup window has
+// passed at the given time in a single write transaction. A non-positive limit
+// deletes all of them.
+func (bs *boltStore) gcAlertGroups(now time.Time, limit int) (int, error) {
+	var numDeleted int
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketAlertGroups))
+		rootC := root.Cursor()
+
+		for topic, _ := rootC.First(); topic != nil; topic, _ = rootC.Next() {
+			cfg, err := getTopicConfig(tx, topic)
+			if err != nil {
+				return err
+			}
+			var window time.Duration
+			if cfg.Alertmanager != nil {
+				window = time.Duration(cfg.Alertmanager.DedupWindow)
+			}
+			olderThan := now.Add(-window).UnixNano()
+
+			gb := root.Bucket(topic)
+			var expired [][]byte
+			c := gb.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if limit > 0 && numDeleted+len(expired) == limit {
+					break
+				}
+				if int64(binary.BigEndian.Uint64(v)) < olderThan {
+					expired = append(expired, k)
+				}
+			}
+			for _, k := range expired {
+				if err := gb.Delete(k); err != nil {
+					return fmt.Errorf("unable to delete alert group: %v", err)
+				}
+			}
+			numDeleted += len(expired)
+			if limit > 0 && numDeleted == limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bs.gcBatches.Inc()
+	return numDeleted, nil
+}
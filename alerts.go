@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// Per topic, bucketAlerts maps the fingerprints of currently firing alerts
+	// to their state.
+	bucketAlerts = "alerts"
+	// Per topic, bucketAlertHistory indexes the messages that reported on each
+	// alert, keyed by alert fingerprint and message index.
+	bucketAlertHistory = "alertHistory"
+)
+
+var (
+	// errAlertsNotTracked is returned when querying the alerts of a topic that
+	// is not configured to receive Alertmanager notifications.
+	errAlertsNotTracked = errors.New("topic does not track alerts")
+	// errAlertNotFound is returned when querying an alert that has not been
+	// reported in a topic's messages.
+	errAlertNotFound = errors.New("alert not found")
+)
+
+// An AlertState is the latest known state of an alert, as of the message with
+// the given index.
+type AlertState struct {
+	Fingerprint  string            `json:"fingerprint"`
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+	Index        uint64            `json:"index"`
+}
+
+// An AlertsResponse lists the alerts of a topic for a given generation ID.
+type AlertsResponse struct {
+	GenerationID string       `json:"generationID"`
+	Alerts       []AlertState `json:"alerts"`
+}
+
+// An AlertTransition is a change of an alert's status, as reported by the
+// message with the given index. The timestamp is the time at which the alert
+// started or stopped firing. For resolved transitions, DurationSeconds is the
+// time for which the alert fired before.
+type AlertTransition struct {
+	Status          string    `json:"status"`
+	Timestamp       time.Time `json:"timestamp"`
+	Index           uint64    `json:"index"`
+	DurationSeconds float64   `json:"durationSeconds,omitempty"`
+}
+
+// An AlertHistoryResponse lists the status transitions of an alert, oldest
+// first, for a given generation ID.
+type AlertHistoryResponse struct {
+	GenerationID string            `json:"generationID"`
+	Fingerprint  string            `json:"fingerprint"`
+	Labels       map[string]string `json:"labels"`
+	Transitions  []AlertTransition `json:"transitions"`
+}
+
+// alertHistoryKey returns the key of a message in the alert history index.
+func alertHistoryKey(fingerprint string, idx uint64) []byte {
+	return append([]byte(fingerprint), keyFromIndex(idx)...)
+}
+
+// alertsOf returns the alerts contained in the JSON-encoded data of a message,
+// which may be an Alertmanager notification or a single alert of a split one.
+func alertsOf(data []byte) []alertmanagerAlert {
+	var n alertmanagerNotification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil
+	}
+	if n.GroupKey != "" {
+		return n.Alerts
+	}
+	var a splitAlert
+	if err := json.Unmarshal(data, &a); err != nil || a.Fingerprint == "" {
+		return nil
+	}
+	return []alertmanagerAlert{a.alertmanagerAlert}
+}
+
+// trackAlerts updates the alert states of a topic with the alerts contained in
+// the JSON-encoded data of the message with the given index. Firing alerts are
+// added or updated, resolved ones are removed.
+func trackAlerts(tx *bolt.Tx, topic []byte, idx uint64, data []byte) error {
+	alerts := alertsOf(data)
+	if len(alerts) == 0 {
+		return nil
+	}
+	ab, err := tx.Bucket([]byte(bucketAlerts)).CreateBucketIfNotExists(topic)
+	if err != nil {
+		return fmt.Errorf("error creating alerts bucket for topic %q: %v", topic, err)
+	}
+	hb, err := tx.Bucket([]byte(bucketAlertHistory)).CreateBucketIfNotExists(topic)
+	if err != nil {
+		return fmt.Errorf("error creating alert history bucket for topic %q: %v", topic, err)
+	}
+
+	for _, a := range alerts {
+		fp := alertFingerprint(a.Labels)
+		if err := hb.Put(alertHistoryKey(fp, idx), nil); err != nil {
+			return fmt.Errorf("error indexing alert history: %v", err)
+		}
+		if a.Status != "firing" {
+			if err := ab.Delete([]byte(fp)); err != nil {
+				return fmt.Errorf("error deleting alert state: %v", err)
+			}
+			continue
+		}
+		if err := putAlertState(ab, fp, a, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putAlertState stores the state of a firing alert as reported by the message
+// with the given index.
+func putAlertState(ab *bolt.Bucket, fp string, a alertmanagerAlert, idx uint64) error {
+	buf, err := json.Marshal(AlertState{
+		Fingerprint:  fp,
+		Status:       a.Status,
+		Labels:       a.Labels,
+		Annotations:  a.Annotations,
+		StartsAt:     a.StartsAt,
+		GeneratorURL: a.GeneratorURL,
+		Index:        idx,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling alert state: %v", err)
+	}
+	if err := ab.Put([]byte(fp), buf); err != nil {
+		return fmt.Errorf("error storing alert state: %v", err)
+	}
+	return nil
+}
+
+// latestAlertReport returns the index of the latest message in the alert
+// history of the given fingerprint, and whether there is any.
+func latestAlertReport(hb *bolt.Bucket, fp string) (uint64, bool) {
+	prefix := []byte(fp)
+	end := alertHistoryKey(fp, math.MaxUint64)
+	c := hb.Cursor()
+	k, _ := c.Seek(end)
+	if k == nil {
+		k, _ = c.Last()
+	} else if !bytes.Equal(k, end) {
+		k, _ = c.Prev()
+	}
+	if k == nil || !bytes.HasPrefix(k, prefix) || len(k) != len(prefix)+8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(k[len(prefix):]), true
+}
+
+// untrackAlerts removes a message that is purged or deleted from the alert
+// history of a topic. The states of alerts that the message reported on last
+// are recomputed from the messages that remain, so that no data of the message
+// is kept in them.
+func untrackAlerts(tx *bolt.Tx, topic []byte, idx uint64, data interface{}) error {
+	hb := tx.Bucket([]byte(bucketAlertHistory)).Bucket(topic)
+	if hb == nil {
+		return nil
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error marshalling message data: %v", err)
+	}
+	for _, a := range alertsOf(buf) {
+		fp := alertFingerprint(a.Labels)
+		latest, _ := latestAlertReport(hb, fp)
+		if err := hb.Delete(alertHistoryKey(fp, idx)); err != nil {
+			return fmt.Errorf("error deleting alert history: %v", err)
+		}
+		if latest == idx {
+			if err := resetAlertState(tx, topic, hb, fp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetAlertState recomputes the state of an alert from the latest message in
+// its history.
+func resetAlertState(tx *bolt.Tx, topic []byte, hb *bolt.Bucket, fp string) error {
+	ab := tx.Bucket([]byte(bucketAlerts)).Bucket(topic)
+	if ab == nil {
+		return nil
+	}
+	if err := ab.Delete([]byte(fp)); err != nil {
+		return fmt.Errorf("error deleting alert state: %v", err)
+	}
+	idx, ok := latestAlertReport(hb, fp)
+	if !ok {
+		return nil
+	}
+	v := tx.Bucket([]byte(bucketMessages)).Bucket(topic).Get(keyFromIndex(idx))
+	if v == nil {
+		return nil
+	}
+	var n struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(v, &n); err != nil {
+		return fmt.Errorf("unable to unmarshal message: %v", err)
+	}
+	for _, a := range alertsOf(n.Data) {
+		if alertFingerprint(a.Labels) == fp && a.Status == "firing" {
+			return putAlertState(ab, fp, a, idx)
+		}
+	}
+	return nil
+}
+
+// trackMessageAlerts updates the alert states of a topic with appended
+// messages, if the topic receives Alertmanager notifications.
+func trackMessageAlerts(tx *bolt.Tx, topic []byte, cfg *TopicConfig, msgs []Message) error {
+	if cfg.Alertmanager == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg.Data)
+		if err != nil {
+			return fmt.Errorf("error marshalling message data: %v", err)
+		}
+		if err := trackAlerts(tx, topic, msg.Index, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildAlerts replays the messages of a topic to recompute its alert states
+// and history from scratch. Topics that don't receive Alertmanager notifications have no
+// alert states.
+func rebuildAlerts(tx *bolt.Tx, topic []byte, cfg *TopicConfig) error {
+	for _, name := range []string{bucketAlerts, bucketAlertHistory} {
+		root := tx.Bucket([]byte(name))
+		if root.Bucket(topic) == nil {
+			continue
+		}
+		if err := root.DeleteBucket(topic); err != nil {
+			return fmt.Errorf("error deleting %s bucket for topic %q: %v", name, topic, err)
+		}
+	}
+	b := tx.Bucket([]byte(bucketMessages)).Bucket(topic)
+	if cfg.Alertmanager == nil || b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		var n struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(v, &n); err != nil {
+			return fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		return trackAlerts(tx, topic, binary.BigEndian.Uint64(k), n.Data)
+	})
+}
+
+// rebuildAllAlerts recomputes the alert states of all topics.
+func rebuildAllAlerts(tx *bolt.Tx) error {
+	return tx.Bucket([]byte(bucketMessages)).ForEach(func(topic, _ []byte) error {
+		cfg, err := getTopicConfig(tx, topic)
+		if err != nil {
+			return err
+		}
+		return rebuildAlerts(tx, topic, cfg)
+	})
+}
+
+// getAlerts returns the currently firing alerts of a topic that match all of
+// the given matchers.
+func (bs *boltStore) getAlerts(topic string, matchers []*labelMatcher) (*AlertsResponse, error) {
+	resp := &AlertsResponse{
+		GenerationID: bs.generationID,
+		Alerts:       []AlertState{},
+	}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic)) == nil {
+			return errTopicNotFound
+		}
+		cfg, err := getTopicConfig(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		if cfg.Alertmanager == nil {
+			return errAlertsNotTracked
+		}
+
+		ab := tx.Bucket([]byte(bucketAlerts)).Bucket([]byte(topic))
+		if ab == nil {
+			return nil
+		}
+		return ab.ForEach(func(_, v []byte) error {
+			var a AlertState
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("unable to unmarshal alert state: %v", err)
+			}
+			if matchLabels(matchers, a.Labels) {
+				resp.Alerts = append(resp.Alerts, a)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// getAlertHistory returns the status transitions of the alert with the given
+// fingerprint that are reported by the messages a topic still holds.
+// Consecutive reports of the same status are collapsed into one transition.
+func (bs *boltStore) getAlertHistory(topic string, fingerprint string) (*AlertHistoryResponse, error) {
+	resp := &AlertHistoryResponse{
+		GenerationID: bs.generationID,
+		Fingerprint:  fingerprint,
+		Transitions:  []AlertTransition{},
+	}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic))
+		if b == nil {
+			return errTopicNotFound
+		}
+		cfg, err := getTopicConfig(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		if cfg.Alertmanager == nil {
+			return errAlertsNotTracked
+		}
+		hb := tx.Bucket([]byte(bucketAlertHistory)).Bucket([]byte(topic))
+		if hb == nil {
+			return errAlertNotFound
+		}
+
+		var firingSince time.Time
+		prefix := []byte(fingerprint)
+		c := hb.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+8; k, _ = c.Next() {
+			idx := binary.BigEndian.Uint64(k[len(prefix):])
+			v := b.Get(keyFromIndex(idx))
+			if v == nil {
+				continue
+			}
+			var n struct {
+				Timestamp time.Time       `json:"timestamp"`
+				Data      json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("unable to unmarshal message: %v", err)
+			}
+
+			for _, a := range alertsOf(n.Data) {
+				if alertFingerprint(a.Labels) != fingerprint {
+					continue
+				}
+				resp.Labels = a.Labels
+				if last := len(resp.Transitions) - 1; last >= 0 && resp.Transitions[last].Status == a.Status {
+					continue
+				}
+
+				t := AlertTransition{
+					Status:    a.Status,
+					Timestamp: n.Timestamp,
+					Index:     idx,
+				}
+				if a.Status == "firing" {
+					if !a.StartsAt.IsZero() {
+						t.Timestamp = a.StartsAt
+					}
+					firingSince = t.Timestamp
+				} else {
+					if !a.EndsAt.IsZero() {
+						t.Timestamp = a.EndsAt
+					}
+					if !firingSince.IsZero() {
+						t.DurationSeconds = t.Timestamp.Sub(firingSince).Seconds()
+					}
+					firingSince = time.Time{}
+				}
+				resp.Transitions = append(resp.Transitions, t)
+			}
+		}
+		if len(resp.Transitions) == 0 {
+			return errAlertNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// errStoreClosed is returned for writes that are attempted after the store has
+// been closed.
+var errStoreClosed = errors.New("message store closed")
+
+// A commitQueue coalesces concurrent write transactions into shared database
+// transactions (group commit). While one transaction is being committed, new
+// writes queue up and are then committed together, so that concurrent writers
+// share a single fsync instead of each paying for their own.
+type commitQueue struct {
+	db *bolt.DB
+	// maxDelay is the maximum time to wait for further writes to join a
+	// transaction. If it is zero, a transaction only includes the writes that
+	// are already queued.
+	maxDelay time.Duration
+	// maxSize is the maximum number of writes per transaction. Values below 2
+	// disable group commits.
+	maxSize int
+
+	requests chan *commitRequest
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type commitRequest struct {
+	fn  func(*bolt.Tx) error
+	err chan error
+}
+
+func newCommitQueue(db *bolt.DB, maxDelay time.Duration, maxSize int) *commitQueue {
+	cq := &commitQueue{
+		db:       db,
+		maxDelay: maxDelay,
+		maxSize:  maxSize,
+		requests: make(chan *commitRequest),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go cq.run()
+	return cq
+}
+
+// update runs fn in a read-write transaction that may be shared with other
+// concurrent writes. fn may be called more than once, so it must not have any
+// side effects outside of the transaction.
+func (cq *commitQueue) update(fn func(*bolt.Tx) error) error {
+	req := &commitRequest{
+		fn:  fn,
+		err: make(chan error, 1),
+	}
+	select {
+	case cq.requests <- req:
+	case <-cq.stop:
+		return errStoreClosed
+	}
+	return <-req.err
+}
+
+func (cq *commitQueue) run() {
+	defer close(cq.done)
+	for {
+		select {
+		case <-cq.stop:
+			return
+		case req := <-cq.requests:
+			cq.commit(cq.collect(req))
+		}
+	}
+}
+
+// collect gathers further queued writes to commit together with the first one.
+func (cq *commitQueue) collect(first *commitRequest) []*commitRequest {
+	reqs := []*commitRequest{first}
+
+	var timeout <-chan time.Time
+	if cq.maxDelay > 0 {
+		timer := time.NewTimer(cq.maxDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(reqs) < cq.maxSize {
+		if timeout == nil {
+			select {
+			case req := <-cq.requests:
+				reqs = append(reqs, req)
+			default:
+				return reqs
+			}
+		} else {
+			select {
+			case req := <-cq.requests:
+				reqs = append(reqs, req)
+			case <-timeout:
+				return reqs
+			}
+		}
+	}
+	return reqs
+}
+
+// commit runs the given writes in a shared transaction. A failing write rolls
+// back the whole transaction, so it is failed on its own and the others are
+// retried together. Since they are retried in the same order, the failing write
+// sees the same state as it would have if the others had been committed.
+func (cq *commitQueue) commit(reqs []*commitRequest) {
+	for len(reqs) > 0 {
+		failed := -1
+		var failedErr error
+		err := cq.db.Update(func(tx *bolt.Tx) error {
+			for i, req := range reqs {
+				if err := req.fn(tx); err != nil {
+					failed, failedErr = i, err
+					return err
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, req := range reqs {
+				req.err <- err
+			}
+			return
+		}
+		reqs[failed].err <- failedErr
+		reqs = append(append([]*commitRequest{}, reqs[:failed]...), reqs[failed+1:]...)
+	}
+}
+
+// close stops accepting writes and waits for writes in progress to complete.
+func (cq *commitQueue) close() {
+	close(cq.stop)
+	<-cq.done
+}
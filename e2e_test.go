@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,14 +30,22 @@ func initServer(dir string, t *testing.T) {
 	if serverStarted {
 		return
 	}
-	retention := 24 * time.Hour
-	gcInterval := 10 * time.Minute
-	pushInterval := 1 * time.Millisecond
 	serverStarted = true
 	go func() {
-		storagePath := filepath.Join(dir, "messages.db")
 		t.Logf("starting server")
-		err := runService(storagePath, listenAddr, retention, gcInterval, pushInterval)
+		err := runService(listenAddr, &boltStoreOptions{
+			path:              filepath.Join(dir, "messages.db"),
+			retention:         24 * time.Hour,
+			gcInterval:        10 * time.Minute,
+			gcBatchSize:       1000,
+			idempotencyWindow: time.Hour,
+		}, &webOptions{
+			pushInterval:    time.Millisecond,
+			maxMessageBytes: 64 << 10,
+			meta: metaOptions{
+				headers: []string{"User-Agent", "X-Request-ID"},
+			},
+		})
 		t.Fatalf("server encountered unexpected error: %v", err)
 	}()
 	if err := waitServerStart(); err != nil {
@@ -170,6 +179,258 @@ func TestE2EWatch(t *testing.T) {
 	}
 }
 
+func TestE2EAppendResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+	genID, err := getGenerationID()
+	if err != nil {
+		t.Fatalf("failed to retrieve generation ID from server: %v", err)
+	}
+
+	for idx := uint64(1); idx <= 3; idx++ {
+		resp, err := doHTTPRequest("POST", "/topics/appendResponseTopic", nil, bytes.NewBufferString(`{"A": "Hi"}`))
+		if err != nil {
+			t.Fatalf("failed to perform append: %v", err)
+		}
+		var appendResp AppendResponse
+		err = json.NewDecoder(resp.Body).Decode(&appendResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+
+		if resp.StatusCode != 201 {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+		if appendResp.GenerationID != genID || appendResp.Index != idx || appendResp.Timestamp.IsZero() {
+			t.Fatalf("unexpected append response: %+v", appendResp)
+		}
+		wantLocation := fmt.Sprintf("/topics/appendResponseTopic/messages/%d", idx)
+		if location := resp.Header.Get("Location"); location != wantLocation {
+			t.Fatalf("unexpected location; want %q, got %q", wantLocation, location)
+		}
+	}
+}
+
+func TestE2EIdempotentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	var locations []string
+	for i, wantStatus := range []int{http.StatusCreated, http.StatusOK} {
+		req, err := http.NewRequest("POST", "http://localhost"+listenAddr+"/topics/topicI", bytes.NewBufferString(fmt.Sprintf(`{"attempt": %d}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "retry-me")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("unexpected status of attempt %d; want %d, got %d", i, wantStatus, resp.StatusCode)
+		}
+		locations = append(locations, resp.Header.Get("Location"))
+	}
+	if locations[0] != locations[1] {
+		t.Fatalf("expected retried append to point to the original message; got %q and %q", locations[0], locations[1])
+	}
+}
+
+func TestE2EContentModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	do := func(method, path, contentType, accept, body string, wantStatus int) *http.Response {
+		req, err := http.NewRequest(method, "http://localhost"+listenAddr+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("unexpected status of %s %s; want %d, got %d", method, path, wantStatus, resp.StatusCode)
+		}
+		return resp
+	}
+
+	// JSON values other than objects are only accepted in JSON mode.
+	do("POST", "/topics/topicJSON", "", "", `[1, "two"]`, http.StatusBadRequest).Body.Close()
+	do("PUT", "/topics/topicJSON", "", "", `{"content": "json"}`, http.StatusCreated).Body.Close()
+	do("POST", "/topics/topicJSON", "", "", `[1, "two"]`, http.StatusCreated).Body.Close()
+	do("POST", "/topics/topicJSON/batch", "", "", "1\n\"two\"\n", http.StatusOK).Body.Close()
+	msgs, err := doGet("topicJSON", "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{[]interface{}{1.0, "two"}, 1.0, "two"}
+	for i, msg := range msgs.Messages {
+		if !reflect.DeepEqual(msg.Data, want[i]) {
+			t.Fatalf("unexpected data of message %d; want %v, got %v", i, want[i], msg.Data)
+		}
+	}
+
+	do("PUT", "/topics/topicRaw", "", "", `{"content": "raw"}`, http.StatusCreated).Body.Close()
+	do("PUT", "/topics/topicRaw", "", "", `{"content": "xml"}`, http.StatusBadRequest).Body.Close()
+	do("POST", "/topics/topicRaw", "text/plain", "", "<34>Oct 11 22:14:15 host su: failed", http.StatusCreated).Body.Close()
+	if msgs, err = doGet("topicRaw", "", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := msgs.Messages[0]; msg.Encoding != "base64" || msg.ContentType != "text/plain" || msg.Data != "PDM0Pk9jdCAxMSAyMjoxNDoxNSBob3N0IHN1OiBmYWlsZWQ=" {
+		t.Fatalf("unexpected raw message: %+v", msg)
+	}
+
+	resp := do("GET", "/topics/topicRaw/messages/1", "", "text/plain", "", http.StatusOK)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "<34>Oct 11 22:14:15 host su: failed" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected raw payload %q of type %q", body, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestE2ELongPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	genID, err := getGenerationID()
+	if err != nil {
+		t.Fatalf("failed to retrieve generation ID from server: %v", err)
+	}
+
+	topic := "longPollTopic"
+	item := map[string]interface{}{"A": "Hi", "B": 0.0}
+
+	type result struct {
+		msgs *MessagesResponse
+		err  error
+	}
+	resultChan := make(chan result)
+	go func() {
+		query := make(url.Values)
+		query.Set("generationID", genID)
+		query.Set("fromIndex", "1")
+		query.Set("wait", "10s")
+		resp, err := doHTTPRequest("GET", "/topics/"+topic, query, nil)
+		if err != nil {
+			resultChan <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var msgs MessagesResponse
+		err = json.NewDecoder(resp.Body).Decode(&msgs)
+		resultChan <- result{msgs: &msgs, err: err}
+	}()
+
+	// Give the request a chance to start waiting before appending.
+	time.Sleep(100 * time.Millisecond)
+	if err := doAppend(item, topic); err != nil {
+		t.Fatalf("failed to perform append: %v", err)
+	}
+
+	select {
+	case res := <-resultChan:
+		if res.err != nil {
+			t.Fatalf("failed to get messages from server: %v", res.err)
+		}
+		if len(res.msgs.Messages) != 1 {
+			t.Fatalf("server did not return expected number of objects: %v != 1", len(res.msgs.Messages))
+		}
+		if !reflect.DeepEqual(res.msgs.Messages[0].Data, item) {
+			t.Fatalf("returned item did not match expected: %v != %v", res.msgs.Messages[0].Data, item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for long-polling request to return")
+	}
+}
+
+func TestE2EAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	bodies := []string{
+		`[{"A": "Hi"}, {"A": "Hello"}, {"A": "Bonjour"}]`,
+		"{\"A\": \"Hola\"}\n{\"A\": \"Shalom\"}\n",
+	}
+	wantRanges := [][2]uint64{{1, 3}, {4, 5}}
+	for i, body := range bodies {
+		resp, err := doHTTPRequest("POST", "/topics/batchTopic/batch", nil, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("failed to perform batch append: %v", err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("invalid response to HTTP POST: status %s, body: %s", resp.Status, data)
+		}
+		var batchResp BatchAppendResponse
+		if err := json.Unmarshal(data, &batchResp); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if batchResp.FirstIndex != wantRanges[i][0] || batchResp.LastIndex != wantRanges[i][1] {
+			t.Fatalf("unexpected index range: %+v", batchResp)
+		}
+	}
+
+	msgs, err := doGet("batchTopic", "", "")
+	if err != nil {
+		t.Fatalf("failed to get messages from server: %v", err)
+	}
+	if len(msgs.Messages) != 5 {
+		t.Fatalf("server did not return expected number of objects: %v != 5", len(msgs.Messages))
+	}
+
+	// Topics that split notifications reject batches instead of storing them
+	// unsplit.
+	resp, err := doHTTPRequest("PUT", "/topics/splitBatchTopic", nil, bytes.NewBufferString(`{"alertmanager": {"splitAlerts": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = doHTTPRequest("POST", "/topics/splitBatchTopic/batch", nil, bytes.NewBufferString(`[{"groupKey": "{}:{}", "alerts": []}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status of batch send to splitting topic; want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
 func waitServerStart() error {
 	timeout := time.After(time.Second * 5)
 	for {
@@ -207,7 +468,7 @@ func doAppend(v interface{}, topic string) error {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != 201 {
 		return fmt.Errorf("invalid response to HTTP POST: status %s, body: %s", resp.Status, data)
 	}
 	return nil
@@ -281,3 +542,249 @@ func doHTTPRequest(method, path string, query url.Values, body io.Reader) (*http
 	}
 	return http.DefaultClient.Do(req)
 }
+
+func TestE2ELimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	post := func(path, body string, wantStatus int) {
+		resp, err := http.Post("http://localhost"+listenAddr+path, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("unexpected status of POST %s; want %d, got %d", path, wantStatus, resp.StatusCode)
+		}
+	}
+
+	// The server-wide limit applies to topics without their own.
+	post("/topics/topicLimits", `{"a": "`+strings.Repeat("x", 64<<10)+`"}`, http.StatusRequestEntityTooLarge)
+
+	req, err := http.NewRequest("PUT", "http://localhost"+listenAddr+"/topics/topicLimits", bytes.NewBufferString(`{"maxMessageBytes": 16, "quota": {"maxMessages": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status of PUT; want %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	post("/topics/topicLimits", `{"a": "0123456789"}`, http.StatusRequestEntityTooLarge)
+	post("/topics/topicLimits/batch", `[{"a": 1}, {"a": 2}]`, http.StatusRequestEntityTooLarge)
+	post("/topics/topicLimits", `{"a": 1}`, http.StatusCreated)
+	post("/topics/topicLimits", `{"a": 2}`, http.StatusCreated)
+	post("/topics/topicLimits", `{"a": 3}`, http.StatusInsufficientStorage)
+}
+
+func TestE2ESplitAlertsResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	resp, err := doHTTPRequest("PUT", "/topics/topicSplitResponse", nil, bytes.NewBufferString(`{"alertmanager": {"splitAlerts": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Notifications with one or several alerts get the same response shape.
+	bodies := []string{
+		`{"groupKey": "{}:{}", "alerts": [{"labels": {"alertname": "A"}}]}`,
+		`{"groupKey": "{}:{}", "alerts": [{"labels": {"alertname": "A"}}, {"labels": {"alertname": "B"}}]}`,
+	}
+	wantRanges := [][2]uint64{{1, 1}, {2, 3}}
+	for i, body := range bodies {
+		resp, err := doHTTPRequest("POST", "/topics/topicSplitResponse", nil, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batchResp BatchAppendResponse
+		err = json.NewDecoder(resp.Body).Decode(&batchResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if batchResp.FirstIndex != wantRanges[i][0] || batchResp.LastIndex != wantRanges[i][1] {
+			t.Fatalf("unexpected index range: %+v", batchResp)
+		}
+	}
+}
+
+func TestE2EDeleteFiringAlert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	resp, err := doHTTPRequest("PUT", "/topics/topicDeleteAlert", nil, bytes.NewBufferString(`{"alertmanager": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := doAppend(map[string]interface{}{
+		"groupKey": "{}:{}",
+		"status":   "firing",
+		"alerts": []interface{}{map[string]interface{}{
+			"status":      "firing",
+			"labels":      map[string]interface{}{"alertname": "Leak"},
+			"annotations": map[string]interface{}{"token": "hunter2"},
+		}},
+	}, "topicDeleteAlert"); err != nil {
+		t.Fatal(err)
+	}
+
+	getAlerts := func() string {
+		resp, err := doHTTPRequest("GET", "/topics/topicDeleteAlert/alerts", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if body := getAlerts(); !strings.Contains(body, "hunter2") {
+		t.Fatalf("expected firing alert with annotations, got %s", body)
+	}
+
+	resp, err = doHTTPRequest("DELETE", "/topics/topicDeleteAlert/messages/1", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status of DELETE; want %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	var alerts AlertsResponse
+	body := getAlerts()
+	if err := json.Unmarshal([]byte(body), &alerts); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts.Alerts) != 0 {
+		t.Fatalf("expected no alerts after deleting their message, got %s", body)
+	}
+}
+
+func TestE2EWatchDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	genID, err := getGenerationID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgsChan, errChan, err := initiateWatch("topicWatchDeletion", genID, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func() *MessagesResponse {
+		select {
+		case msgs := <-msgsChan:
+			return msgs
+		case err := <-errChan:
+			t.Fatalf("encountered error during watch: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for messages to be received")
+		}
+		return nil
+	}
+
+	if err := doAppend(map[string]interface{}{"token": "hunter2"}, "topicWatchDeletion"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := receive(); len(msgs.Messages) != 1 || msgs.Messages[0].Deleted {
+		t.Fatalf("expected the appended message, got %+v", msgs)
+	}
+
+	// The watcher already received the message, so its tombstone is pushed.
+	resp, err := doHTTPRequest("DELETE", "/topics/topicWatchDeletion/messages/1", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	msgs := receive()
+	if len(msgs.Messages) != 1 || !msgs.Messages[0].Deleted || msgs.Messages[0].Index != 1 || msgs.Messages[0].Data != nil {
+		t.Fatalf("expected the tombstone of message 1, got %+v", msgs)
+	}
+	if msgs.NextIndex != 2 {
+		t.Fatalf("unexpected next index; want 2, got %d", msgs.NextIndex)
+	}
+}
+
+func TestE2EMessageTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	for ttl, wantStatus := range map[string]int{
+		"5m":    http.StatusCreated,
+		"1h30m": http.StatusCreated,
+		"0s":    http.StatusBadRequest,
+		"-1m":   http.StatusBadRequest,
+		"soon":  http.StatusBadRequest,
+	} {
+		resp, err := doHTTPRequest("POST", "/topics/topicTTL", url.Values{"ttl": {ttl}}, bytes.NewBufferString(`{"status": "alive"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("unexpected status for TTL %q; want %d, got %d", ttl, wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestE2EEventTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	initServer(dir, t)
+
+	for eventTime, wantStatus := range map[string]int{
+		"2017-08-01T14:02:00Z": http.StatusCreated,
+		"1501596120":           http.StatusCreated,
+		"-100":                 http.StatusBadRequest,
+		"0001-01-01T00:00:00Z": http.StatusBadRequest,
+		"3000-01-01T00:00:00Z": http.StatusBadRequest,
+		"yesterday":            http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("POST", "http://localhost"+listenAddr+"/topics/topicEventTime", bytes.NewBufferString(`{"foo": "bar"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Event-Time", eventTime)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("unexpected status for event time %q; want %d, got %d", eventTime, wantStatus, resp.StatusCode)
+		}
+	}
+}
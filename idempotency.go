@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Idempotency keys are stored per topic in two buckets: one maps each key to
+// the timestamp and index range of the messages that were appended with it,
+// the other orders the keys by that timestamp so that GC can find expired keys
+// quickly.
+const (
+	bucketIdempotencyKeys  = "idempotencyKeys"
+	bucketIdempotencyTimes = "idempotencyTimes"
+)
+
+// idempotencyTimeKey returns the key of an idempotency key in the time-ordered
+// bucket, given the big-endian encoded timestamp at which it was first seen.
+func idempotencyTimeKey(ts []byte, key []byte) []byte {
+	buf := make([]byte, 0, len(ts)+len(key))
+	buf = append(buf, ts...)
+	return append(buf, key...)
+}
+
+// lookupIdempotencyKey returns the messages that were appended to a topic with
+// the given idempotency key within the idempotency window, or nil if there are
+// none.
+func (bs *boltStore) lookupIdempotencyKey(tx *bolt.Tx, b *bolt.Bucket, topic []byte, key string, now time.Time) ([]Message, error) {
+	ts, first, last, ok := bs.lookupIdempotencyRange(tx, topic, key, now)
+	if !ok {
+		return nil, nil
+	}
+	return getMessageRange(b, first, last, ts)
+}
+
+// lookupIdempotencyRange returns the time at which messages were appended to a
+// topic with the given idempotency key within the idempotency window, and the
+// range of their indexes. It returns false if there are none.
+func (bs *boltStore) lookupIdempotencyRange(tx *bolt.Tx, topic []byte, key string, now time.Time) (time.Time, uint64, uint64, bool) {
+	kb := tx.Bucket([]byte(bucketIdempotencyKeys)).Bucket(topic)
+	if kb == nil {
+		return time.Time{}, 0, 0, false
+	}
+	v := kb.Get([]byte(key))
+	if v == nil {
+		return time.Time{}, 0, 0, false
+	}
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	if ts.Before(now.Add(-bs.options.idempotencyWindow)) {
+		// Expired, but not garbage-collected yet.
+		return time.Time{}, 0, 0, false
+	}
+	return ts, binary.BigEndian.Uint64(v[8:]), binary.BigEndian.Uint64(v[16:]), true
+}
+
+// putIdempotencyKey records that messages have been appended to a topic with
+// the given idempotency key, replacing any expired record of the same key.
+func putIdempotencyKey(tx *bolt.Tx, topic []byte, key string, msgs []Message) error {
+	kb, err := tx.Bucket([]byte(bucketIdempotencyKeys)).CreateBucketIfNotExists(topic)
+	if err != nil {
+		return fmt.Errorf("error creating idempotency key bucket for topic %q: %v", topic, err)
+	}
+	tb, err := tx.Bucket([]byte(bucketIdempotencyTimes)).CreateBucketIfNotExists(topic)
+	if err != nil {
+		return fmt.Errorf("error creating idempotency key index for topic %q: %v", topic, err)
+	}
+
+	if old := kb.Get([]byte(key)); old != nil {
+		if err := tb.Delete(idempotencyTimeKey(old[:8], []byte(key))); err != nil {
+			return fmt.Errorf("error deleting expired idempotency key: %v", err)
+		}
+	}
+
+	v := make([]byte, 24)
+	binary.BigEndian.PutUint64(v, uint64(msgs[0].Timestamp.UnixNano()))
+	binary.BigEndian.PutUint64(v[8:], msgs[0].Index)
+	binary.BigEndian.PutUint64(v[16:], msgs[len(msgs)-1].Index)
+	if err := kb.Put([]byte(key), v); err != nil {
+		return fmt.Errorf("error storing idempotency key: %v", err)
+	}
+	if err := tb.Put(idempotencyTimeKey(v[:8], []byte(key)), nil); err != nil {
+		return fmt.Errorf("error indexing idempotency key: %v", err)
+	}
+	return nil
+}
+
+// gcIdempotencyKeys deletes up to limit idempotency keys that have expired at
+// the given time in a single write transaction. A non-positive limit deletes
+// all of them.
+func (bs *boltStore) gcIdempotencyKeys(now time.Time, limit int) (int, error) {
+	var numDeleted int
+	olderThan := now.Add(-bs.options.idempotencyWindow).UnixNano()
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		keysRoot := tx.Bucket([]byte(bucketIdempotencyKeys))
+		timesRoot := tx.Bucket([]byte(bucketIdempotencyTimes))
+		timesRootC := timesRoot.Cursor()
+
+		for topic, _ := timesRootC.First(); topic != nil; topic, _ = timesRootC.Next() {
+			kb := keysRoot.Bucket(topic)
+			c := timesRoot.Bucket(topic).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.First() {
+				if limit > 0 && numDeleted == limit {
+					return nil
+				}
+				if int64(binary.BigEndian.Uint64(k)) >= olderThan {
+					break
+				}
+				if err := kb.Delete(k[8:]); err != nil {
+					return fmt.Errorf("unable to delete idempotency key: %v", err)
+				}
+				if err := c.Delete(); err != nil {
+					return fmt.Errorf("unable to delete idempotency key from index: %v", err)
+				}
+				numDeleted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bs.gcBatches.Inc()
+	return numDeleted, nil
+}
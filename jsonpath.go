@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A jsonPath addresses a value within decoded JSON data by a sequence of object
+// keys and array indexes, written like alerts[0].labels.severity.
+type jsonPath []jsonPathElem
+
+type jsonPathElem struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses a path of dot-separated object keys, each optionally
+// followed by any number of bracketed array indexes.
+func parseJSONPath(s string) (jsonPath, error) {
+	var p jsonPath
+	for _, part := range strings.Split(s, ".") {
+		key := part
+		var indexes string
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key, indexes = part[:i], part[i:]
+		}
+		if key == "" || strings.ContainsAny(key, "]") {
+			return nil, fmt.Errorf("invalid JSON path %q", s)
+		}
+		p = append(p, jsonPathElem{key: key})
+
+		for indexes != "" {
+			end := strings.IndexByte(indexes, ']')
+			if indexes[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q", s)
+			}
+			idx, err := strconv.Atoi(indexes[1:end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid array index in JSON path %q", s)
+			}
+			p = append(p, jsonPathElem{index: idx, isIndex: true})
+			indexes = indexes[end+1:]
+		}
+	}
+	return p, nil
+}
+
+// lookup returns the value at the path within the given data, and whether it
+// exists.
+func (p jsonPath) lookup(v interface{}) (interface{}, bool) {
+	for _, e := range p {
+		if e.isIndex {
+			a, ok := v.([]interface{})
+			if !ok || e.index >= len(a) {
+				return nil, false
+			}
+			v = a[e.index]
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[e.key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// lookupString returns the value at the path within the given data as a
+// string. Missing values and nulls are empty, other non-string values are
+// JSON-encoded.
+func (p jsonPath) lookupString(v interface{}) string {
+	v, ok := p.lookup(v)
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+// project trims the given data to only contain the value at the path, nested
+// the same way as in the data, and reports whether that value exists. The data
+// may share values with the result.
+// Object keys are looked up in every element of arrays along the way, keeping
+// the arrays' lengths. Elements that are not selected are null.
+func (p jsonPath) project(v interface{}) (interface{}, bool) {
+	if len(p) == 0 {
+		return v, true
+	}
+
+	e := p[0]
+	if a, ok := v.([]interface{}); ok {
+		res := make([]interface{}, len(a))
+		if e.isIndex {
+			if e.index >= len(a) {
+				return nil, false
+			}
+			sub, ok := p[1:].project(a[e.index])
+			res[e.index] = sub
+			return res, ok
+		}
+		var found bool
+		for i, el := range a {
+			if sub, ok := p.project(el); ok {
+				res[i] = sub
+				found = true
+			}
+		}
+		return res, found
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok || e.isIndex {
+		return nil, false
+	}
+	child, ok := m[e.key]
+	if !ok {
+		return nil, false
+	}
+	sub, ok := p[1:].project(child)
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{e.key: sub}, true
+}
+
+// projectFields trims data to the values at the given paths. It returns nil
+// if none of them exist.
+func projectFields(data interface{}, paths []jsonPath) interface{} {
+	var res interface{}
+	for _, p := range paths {
+		if v, ok := p.project(data); ok {
+			res = mergeProjections(res, v)
+		}
+	}
+	return res
+}
+
+// mergeProjections merges two projections of the same data.
+func mergeProjections(a, b interface{}) interface{} {
+	switch at := a.(type) {
+	case nil:
+		return b
+	case map[string]interface{}:
+		bt, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		for k, v := range bt {
+			at[k] = mergeProjections(at[k], v)
+		}
+		return at
+	case []interface{}:
+		bt, ok := b.([]interface{})
+		if !ok || len(bt) != len(at) {
+			return a
+		}
+		for i := range at {
+			at[i] = mergeProjections(at[i], bt[i])
+		}
+		return at
+	}
+	return a
+}
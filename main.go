@@ -15,24 +15,46 @@ func main() {
 	listenAddr := flag.String("listen-address", ":9099", "The address to listen on for web requests.")
 	retention := flag.Duration("retention", 24*time.Hour, "The retention time after which stored messages will be purged.")
 	gcInterval := flag.Duration("gc-interval", 10*time.Minute, "The interval at which to run garbage collection cycles to purge old entries.")
-	pushInterval := flag.Duration("push-interval", 5*time.Second, "The interval at which to push messages to websocket clients.")
+	gcBatchSize := flag.Int("gc-batch-size", 1000, "The maximum number of entries to purge in a single database transaction during garbage collection. 0 purges all entries of a cycle in one transaction.")
+	pushInterval := flag.Duration("push-interval", 0, "The time window during which to coalesce newly appended messages before pushing them to websocket clients. 0 pushes every message immediately.")
+	strictTopics := flag.Bool("strict-topics", false, "Reject writes to topics that have not been created explicitly.")
+	commitMaxDelay := flag.Duration("commit-max-delay", 0, "The maximum time to wait for further concurrent appends to join a database transaction. 0 only commits appends together that are already waiting.")
+	commitMaxSize := flag.Int("commit-max-size", 1000, "The maximum number of concurrent appends to commit in the same database transaction. 0 disables group commits.")
+	idempotencyWindow := flag.Duration("idempotency-window", time.Hour, "The time for which idempotency keys of appended messages are remembered.")
+	metaHeaders := flag.String("meta-headers", "User-Agent,X-Request-ID", "Comma-separated list of request headers to store along with appended messages.")
+	metaPrincipalHeader := flag.String("meta-principal-header", "", "The request header in which a trusted authenticating proxy passes the principal to store along with appended messages. If empty, no principal is stored.")
+	exposeMeta := flag.Bool("expose-meta", false, "Include the stored request metadata of messages when retrieving them.")
+	maxMessageBytes := flag.Uint64("max-message-bytes", 10<<20, "The maximum size of the request body of an append in bytes, unless a topic sets its own limit. 0 means no limit.")
 	flag.Parse()
 
-	log.Fatal(runService(*storagePath, *listenAddr, *retention, *gcInterval, *pushInterval))
+	log.Fatal(runService(*listenAddr, &boltStoreOptions{
+		path:              *storagePath,
+		retention:         *retention,
+		gcInterval:        *gcInterval,
+		gcBatchSize:       *gcBatchSize,
+		strictTopics:      *strictTopics,
+		commitMaxDelay:    *commitMaxDelay,
+		commitMaxSize:     *commitMaxSize,
+		idempotencyWindow: *idempotencyWindow,
+		exposeMeta:        *exposeMeta,
+	}, &webOptions{
+		pushInterval:    *pushInterval,
+		maxMessageBytes: *maxMessageBytes,
+		meta: metaOptions{
+			headers:         parseHeaderList(*metaHeaders),
+			principalHeader: *metaPrincipalHeader,
+		},
+	}))
 }
 
-func runService(storagePath, listenAddr string, retention, gcInterval, pushInterval time.Duration) error {
+func runService(listenAddr string, storeOpts *boltStoreOptions, webOpts *webOptions) error {
 	registry := prometheus.NewRegistry()
 	// Go-specific metrics about the process (GC stats, goroutines, etc.).
 	registry.MustRegister(prometheus.NewGoCollector())
 	// Go-unrelated process metrics (memory usage, file descriptors, etc.).
 	registry.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
-	store, err := newBoltStore(&boltStoreOptions{
-		path:       storagePath,
-		retention:  retention,
-		gcInterval: gcInterval,
-		registry:   registry,
-	})
+	storeOpts.registry = registry
+	store, err := newBoltStore(storeOpts)
 	if err != nil {
 		return fmt.Errorf("Error opening message store:%v", err)
 	}
@@ -40,5 +62,5 @@ func runService(storagePath, listenAddr string, retention, gcInterval, pushInter
 	defer store.close()
 
 	log.Printf("Listening on %v...", listenAddr)
-	return serve(listenAddr, pushInterval, store, registry)
+	return serve(listenAddr, store, webOpts, registry)
 }
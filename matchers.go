@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// A matchType is the comparison operator of a labelMatcher.
+type matchType string
+
+const (
+	matchEqual     matchType = "="
+	matchNotEqual  matchType = "!="
+	matchRegexp    matchType = "=~"
+	matchNotRegexp matchType = "!~"
+)
+
+// A labelMatcher is a Prometheus-style matcher such as severity=~"critical|page"
+// that selects values by name. Names may also be JSON paths to select values
+// within message data.
+type labelMatcher struct {
+	name  string
+	path  jsonPath
+	op    matchType
+	value string
+	re    *regexp.Regexp
+}
+
+var (
+	matcherRE   = regexp.MustCompile(`^\s*([^\s=!~"]+)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+	labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// parseLabelMatcher parses a matcher of the form name="value", with any of the
+// operators =, !=, =~ and !~, where the name is a label name or a JSON path.
+// Like in Prometheus, regular expressions are fully anchored.
+func parseLabelMatcher(s string) (*labelMatcher, error) {
+	parts := matcherRE.FindStringSubmatch(s)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid matcher %q", s)
+	}
+	value, err := strconv.Unquote(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in matcher %q: %v", s, err)
+	}
+
+	path, err := parseJSONPath(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid name in matcher %q: %v", s, err)
+	}
+
+	m := &labelMatcher{
+		name:  parts[1],
+		path:  path,
+		op:    matchType(parts[2]),
+		value: value,
+	}
+	if m.op == matchRegexp || m.op == matchNotRegexp {
+		m.re, err = regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in matcher %q: %v", s, err)
+		}
+	}
+	return m, nil
+}
+
+// parseLabelMatchers parses a list of matchers.
+func parseLabelMatchers(ss []string) ([]*labelMatcher, error) {
+	matchers := make([]*labelMatcher, 0, len(ss))
+	for _, s := range ss {
+		m, err := parseLabelMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// isLabel reports whether the matcher's name is a plain label name rather than
+// a JSON path.
+func (m *labelMatcher) isLabel() bool {
+	return labelNameRE.MatchString(m.name)
+}
+
+// matches reports whether the matcher selects the given value.
+func (m *labelMatcher) matches(v string) bool {
+	switch m.op {
+	case matchEqual:
+		return v == m.value
+	case matchNotEqual:
+		return v != m.value
+	case matchRegexp:
+		return m.re.MatchString(v)
+	case matchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	panic(fmt.Sprintf("unknown match type %q", m.op))
+}
+
+// matchLabels reports whether all matchers select the given labels. Missing
+// labels have the empty value.
+func matchLabels(matchers []*labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels[m.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchData reports whether all matchers select the given message data. In
+// Alertmanager notifications and split alerts, matchers with plain label names
+// select alert labels, and a notification matches if any of its alerts does.
+// All other matchers select values by JSON path, so that they also work for
+// topics that hold other data.
+func matchData(matchers []*labelMatcher, data interface{}) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+
+	alerts, isAlerts := alertLabelsOf(data)
+	var labelMatchers []*labelMatcher
+	for _, m := range matchers {
+		if isAlerts && m.isLabel() {
+			labelMatchers = append(labelMatchers, m)
+			continue
+		}
+		if !m.matches(m.path.lookupString(data)) {
+			return false
+		}
+	}
+	if labelMatchers == nil {
+		return true
+	}
+	for _, labels := range alerts {
+		if matchLabels(labelMatchers, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// alertLabelsOf returns the labels of the alerts in decoded message data, and
+// whether the data is an Alertmanager notification or a split alert at all.
+func alertLabelsOf(data interface{}) ([]map[string]string, bool) {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	var alerts []interface{}
+	if groupKey, _ := m["groupKey"].(string); groupKey != "" {
+		alerts, _ = m["alerts"].([]interface{})
+	} else if fp, _ := m["fingerprint"].(string); fp != "" {
+		alerts = []interface{}{m}
+	} else {
+		return nil, false
+	}
+
+	labels := make([]map[string]string, 0, len(alerts))
+	for _, a := range alerts {
+		am, _ := a.(map[string]interface{})
+		lm, _ := am["labels"].(map[string]interface{})
+		ls := make(map[string]string, len(lm))
+		for ln, lv := range lm {
+			ls[ln], _ = lv.(string)
+		}
+		labels = append(labels, ls)
+	}
+	return labels, true
+}
@@ -3,15 +3,79 @@ package main
 import "time"
 
 // A MessagesResponse contains a sequence of messages for a given generation ID.
+// NextIndex is the index to continue reading from, and HasMore indicates whether
+// further messages are available beyond it.
 type MessagesResponse struct {
 	GenerationID string    `json:"generationID"`
 	Messages     []Message `json:"messages"`
+	NextIndex    uint64    `json:"nextIndex"`
+	HasMore      bool      `json:"hasMore"`
 }
 
 // A Message models a message with its data and a sequential index that is valid
-// within a given generation ID.
+// within a given generation ID. Deleted messages are kept as tombstones without
+// data, so that clients can tell that the index existed. Repeats and LastSeen
+// are set on messages that identical Alertmanager notifications have been
+// collapsed into. Raw payloads are stored as base64-encoded strings, which is
+// indicated by their encoding, along with their content type. Meta describes
+// the request that the message was appended with, if the store exposes it.
+// EventTime is the time of the event that the message describes, if its
+// producer supplied one, as opposed to the time at which it was stored.
+// Messages with an expiry time are hidden once it has passed, and purged by the
+// next GC cycle.
 type Message struct {
-	Index     uint64      `json:"index"`
-	Timestamp time.Time   `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	Index       uint64       `json:"index"`
+	Timestamp   time.Time    `json:"timestamp"`
+	EventTime   *time.Time   `json:"eventTime,omitempty"`
+	ExpiresAt   *time.Time   `json:"expiresAt,omitempty"`
+	Data        interface{}  `json:"data"`
+	Encoding    string       `json:"encoding,omitempty"`
+	ContentType string       `json:"contentType,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	Repeats     uint64       `json:"repeats,omitempty"`
+	LastSeen    *time.Time   `json:"lastSeen,omitempty"`
+	Meta        *MessageMeta `json:"meta,omitempty"`
+}
+
+// eventTime returns the event time of the message, or its timestamp if it has
+// none.
+func (n *Message) eventTime() time.Time {
+	if n.EventTime != nil {
+		return *n.EventTime
+	}
+	return n.Timestamp
+}
+
+// tombstone returns the tombstone that replaces the message when it is deleted.
+func (n *Message) tombstone() Message {
+	return Message{
+		Index:     n.Index,
+		Timestamp: n.Timestamp,
+		EventTime: n.EventTime,
+		ExpiresAt: n.ExpiresAt,
+		Deleted:   true,
+	}
+}
+
+// expired returns whether the message has expired at the given time.
+func (n *Message) expired(now time.Time) bool {
+	return n.ExpiresAt != nil && !now.Before(*n.ExpiresAt)
+}
+
+// encodingBase64 is the encoding of raw message payloads.
+const encodingBase64 = "base64"
+
+// An AppendResponse identifies a newly appended message.
+type AppendResponse struct {
+	GenerationID string    `json:"generationID"`
+	Index        uint64    `json:"index"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// A BatchAppendResponse reports the range of indexes assigned to a batch of
+// appended messages.
+type BatchAppendResponse struct {
+	GenerationID string `json:"generationID"`
+	FirstIndex   uint64 `json:"firstIndex"`
+	LastIndex    uint64 `json:"lastIndex"`
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A MessageMeta describes the request that a message was appended with.
+type MessageMeta struct {
+	RemoteAddr string            `json:"remoteAddr,omitempty"`
+	Principal  string            `json:"principal,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Receiver is the Alertmanager receiver of a webhook notification.
+	Receiver string `json:"receiver,omitempty"`
+}
+
+// metaOptions configures which request metadata is stored along with appended
+// messages.
+type metaOptions struct {
+	// headers lists the request headers to store.
+	headers []string
+	// principalHeader is the header in which a trusted authenticating proxy
+	// passes the authenticated principal. If it is empty, no principal is
+	// stored, since the server doesn't authenticate requests itself.
+	principalHeader string
+}
+
+// parseHeaderList parses a comma-separated list of header names.
+func parseHeaderList(s string) []string {
+	var headers []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// capture returns the metadata of an append request with the given decoded
+// body.
+func (o *metaOptions) capture(r *http.Request, data interface{}) *MessageMeta {
+	meta := &MessageMeta{
+		RemoteAddr: r.RemoteAddr,
+	}
+	if o.principalHeader != "" {
+		meta.Principal = r.Header.Get(o.principalHeader)
+	}
+	for _, h := range o.headers {
+		if v := r.Header.Get(h); v != "" {
+			if meta.Headers == nil {
+				meta.Headers = map[string]string{}
+			}
+			meta.Headers[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	if m, ok := data.(map[string]interface{}); ok {
+		if _, ok := m["groupKey"]; ok {
+			meta.Receiver, _ = m["receiver"].(string)
+		}
+	}
+	return meta
+}
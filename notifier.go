@@ -0,0 +1,125 @@
+package main
+
+import "sync"
+
+// A topicNotifier broadcasts append events to any number of waiters on a
+// per-topic basis. Waiting is free for idle topics: no goroutines or timers
+// are involved, only a channel that is closed on the next append. It also
+// passes deleted messages on to the deletion watches of their topic.
+type topicNotifier struct {
+	mtx       sync.Mutex
+	waiters   map[string]*topicWaiters
+	deletions map[string]map[*deletionWatch]struct{}
+}
+
+// topicWaiters are the current waiters of a topic.
+type topicWaiters struct {
+	appended chan struct{}
+	count    int
+}
+
+func newTopicNotifier() *topicNotifier {
+	return &topicNotifier{
+		waiters:   map[string]*topicWaiters{},
+		deletions: map[string]map[*deletionWatch]struct{}{},
+	}
+}
+
+// A deletionWatch collects the messages deleted from a topic.
+type deletionWatch struct {
+	mtx     sync.Mutex
+	deleted []Message
+	// ready holds a value while deleted messages are pending.
+	ready chan struct{}
+}
+
+// take returns and forgets the pending deleted messages.
+func (dw *deletionWatch) take() []Message {
+	dw.mtx.Lock()
+	defer dw.mtx.Unlock()
+
+	deleted := dw.deleted
+	dw.deleted = nil
+	select {
+	case <-dw.ready:
+	default:
+	}
+	return deleted
+}
+
+// wait returns a channel that is closed once the next message has been appended
+// to the given topic, along with a function that must be called once when the
+// caller stops waiting. To avoid missing appends, callers should obtain the
+// channel before reading the topic's current state.
+func (tn *topicNotifier) wait(topic string) (<-chan struct{}, func()) {
+	tn.mtx.Lock()
+	defer tn.mtx.Unlock()
+
+	tw, ok := tn.waiters[topic]
+	if !ok {
+		tw = &topicWaiters{appended: make(chan struct{})}
+		tn.waiters[topic] = tw
+	}
+	tw.count++
+	return tw.appended, func() {
+		tn.mtx.Lock()
+		defer tn.mtx.Unlock()
+
+		// Forget topics nobody waits for, so that waiting on topics that are
+		// never appended to doesn't leak memory.
+		tw.count--
+		if tw.count == 0 && tn.waiters[topic] == tw {
+			delete(tn.waiters, topic)
+		}
+	}
+}
+
+// watchDeletions returns a deletion watch for the given topic, along with a
+// function that stops it.
+func (tn *topicNotifier) watchDeletions(topic string) (*deletionWatch, func()) {
+	tn.mtx.Lock()
+	defer tn.mtx.Unlock()
+
+	dw := &deletionWatch{ready: make(chan struct{}, 1)}
+	if tn.deletions[topic] == nil {
+		tn.deletions[topic] = map[*deletionWatch]struct{}{}
+	}
+	tn.deletions[topic][dw] = struct{}{}
+	return dw, func() {
+		tn.mtx.Lock()
+		defer tn.mtx.Unlock()
+
+		delete(tn.deletions[topic], dw)
+		if len(tn.deletions[topic]) == 0 {
+			delete(tn.deletions, topic)
+		}
+	}
+}
+
+// notifyDeleted passes the message that was deleted from the given topic on to
+// the topic's deletion watches.
+func (tn *topicNotifier) notifyDeleted(topic string, n Message) {
+	tn.mtx.Lock()
+	defer tn.mtx.Unlock()
+
+	for dw := range tn.deletions[topic] {
+		dw.mtx.Lock()
+		dw.deleted = append(dw.deleted, n)
+		select {
+		case dw.ready <- struct{}{}:
+		default:
+		}
+		dw.mtx.Unlock()
+	}
+}
+
+// notify wakes up all current waiters of the given topic.
+func (tn *topicNotifier) notify(topic string) {
+	tn.mtx.Lock()
+	defer tn.mtx.Unlock()
+
+	if tw, ok := tn.waiters[topic]; ok {
+		close(tw.appended)
+		delete(tn.waiters, topic)
+	}
+}
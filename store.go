@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"runtime"
+	"sort"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -13,27 +18,146 @@ import (
 )
 
 const (
-	bucketMetadata = "metadata"
-	bucketMessages = "messages"
+	bucketMetadata   = "metadata"
+	bucketMessages   = "messages"
+	bucketTimestamps = "timestamps"
+	// bucketEventTimes indexes the messages of each topic by event time, like
+	// bucketTimestamps does by ingestion time.
+	bucketEventTimes = "eventTimes"
+	// Per topic, bucketExpiries indexes the messages that expire by their
+	// expiry time.
+	bucketExpiries = "expiries"
+
+	// Nested buckets within the metadata bucket that hold per-topic
+	// information, keyed by topic.
+	bucketTopicConfigs   = "topics"
+	bucketTopicStats     = "stats"
+	bucketTopicSequences = "sequences"
 
 	keyGenerationID = "generationID"
 )
 
+// topicIndexBuckets are root buckets that hold auxiliary per-topic data in
+// nested buckets keyed by topic, which are dropped along with their topic.
+var topicIndexBuckets = []string{
+	bucketEventTimes,
+	bucketExpiries,
+	bucketIdempotencyKeys,
+	bucketIdempotencyTimes,
+	bucketAlertGroups,
+	bucketAlerts,
+	bucketAlertHistory,
+}
+
 type messageStore interface {
-	append(topic string, data interface{}) error
-	get(topic string, generationID string, fromIndex uint64) (*MessagesResponse, error)
+	append(topic string, data interface{}, opts appendOptions) ([]Message, bool, error)
+	appendBatch(topic string, data []interface{}, opts appendOptions) (*BatchAppendResponse, error)
+	get(topic string, q messageQuery) (*MessagesResponse, error)
+	wait(topic string) (<-chan struct{}, func())
+	watchDeletions(topic string) (*deletionWatch, func())
+	generation() string
+	setTopicConfig(topic string, cfg *TopicConfig) (bool, error)
+	listTopics() (*TopicsResponse, error)
+	deleteTopic(topic string) error
+	getMessage(topic string, index uint64) (*Message, error)
+	deleteMessage(topic string, index uint64) error
+	getAlerts(topic string, matchers []*labelMatcher) (*AlertsResponse, error)
+	getAlertHistory(topic string, fingerprint string) (*AlertHistoryResponse, error)
+	topicConfig(topic string) (*TopicConfig, error)
+}
+
+// errTopicNotFound is returned for operations on topics that don't exist when
+// they can't be created implicitly.
+var errTopicNotFound = errors.New("topic not found")
+
+// errMessageNotFound is returned for operations on messages that don't exist.
+var errMessageNotFound = errors.New("message not found")
+
+// errQuotaExceeded is returned for appends that would exceed a topic's quota.
+var errQuotaExceeded = errors.New("topic quota exceeded")
+
+// appendOptions holds optional settings for appending a message.
+type appendOptions struct {
+	// If a message has already been appended to the topic with the same
+	// idempotencyKey within the store's idempotency window, no new message is
+	// appended.
+	idempotencyKey string
+	// contentType is the content type of raw data, which is given as a byte
+	// slice.
+	contentType string
+	// meta describes the request that the message was appended with.
+	meta *MessageMeta
+	// If eventTime is set, it is the time of the event that the message
+	// describes. Otherwise, it is taken from the data at the topic's event
+	// time path, if any.
+	eventTime *time.Time
+	// If ttl is positive, the message expires after it.
+	ttl time.Duration
+}
+
+// A messageQuery selects which messages of a topic to retrieve.
+type messageQuery struct {
+	generationID string
+	fromIndex    uint64
+	// If limit is positive, at most limit messages are returned.
+	limit int
+	// If set, only messages with timestamps in the inclusive range of since
+	// and until are returned.
+	since time.Time
+	until time.Time
+	// If eventTime is set, the time range applies to the event times of
+	// messages instead of their timestamps.
+	eventTime bool
+	// If set, only messages whose data is selected by all matchers are
+	// returned.
+	matchers []*labelMatcher
+	// If set, the data of returned messages is trimmed to the values at these
+	// paths.
+	fields []jsonPath
+}
+
+// hasTimeRange returns whether the query is restricted to a time range.
+func (q messageQuery) hasTimeRange() bool {
+	return !q.since.IsZero() || !q.until.IsZero()
+}
+
+// rangeEnded returns whether no further messages can be appended within the
+// query's time range at the given time. New messages are timestamped after it,
+// while event times are supplied by producers, so they can still be in it.
+func (q messageQuery) rangeEnded(now time.Time) bool {
+	return !q.until.IsZero() && !q.eventTime && now.After(q.until)
+}
+
+// matchesTime returns whether the given message is within the query's time
+// range.
+func (q messageQuery) matchesTime(n Message) bool {
+	ts := n.Timestamp
+	if q.eventTime {
+		ts = n.eventTime()
+	}
+	if !q.since.IsZero() && ts.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && ts.After(q.until) {
+		return false
+	}
+	return true
 }
 
 type boltStore struct {
 	db           *bolt.DB
 	generationID string
 	options      *boltStoreOptions
+	notifier     *topicNotifier
+	commits      *commitQueue
 
 	totalAppends  *prometheus.CounterVec
 	failedAppends *prometheus.CounterVec
 	totalGets     *prometheus.CounterVec
 	failedGets    *prometheus.CounterVec
 	gcDuration    prometheus.Histogram
+	gcBatches     prometheus.Counter
+	gcDeleted     prometheus.Counter
 
 	stop chan struct{}
 	done chan struct{}
@@ -42,7 +166,24 @@ type boltStore struct {
 type boltStoreOptions struct {
 	retention  time.Duration
 	gcInterval time.Duration
-	path       string
+	// gcBatchSize limits the number of messages deleted per write transaction
+	// during GC, so that appends are not blocked for a whole GC cycle.
+	gcBatchSize int
+	path        string
+	// If strictTopics is set, appends to topics that haven't been created
+	// explicitly fail instead of creating the topic.
+	strictTopics bool
+	// Concurrent appends are committed together in shared transactions of up
+	// to commitMaxSize appends, waiting at most commitMaxDelay for further
+	// appends to join.
+	commitMaxDelay time.Duration
+	commitMaxSize  int
+	// idempotencyWindow is the time for which idempotency keys of appended
+	// messages are remembered.
+	idempotencyWindow time.Duration
+	// If exposeMeta is set, retrieved messages include the metadata of the
+	// requests they were appended with.
+	exposeMeta bool
 
 	registry *prometheus.Registry
 }
@@ -54,10 +195,11 @@ func newBoltStore(opts *boltStoreOptions) (*boltStore, error) {
 	}
 
 	store := &boltStore{
-		db:      db,
-		options: opts,
-		stop:    make(chan struct{}),
-		done:    make(chan struct{}),
+		db:       db,
+		options:  opts,
+		notifier: newTopicNotifier(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 
 		totalAppends: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "message_store_appends_total",
@@ -80,6 +222,14 @@ func newBoltStore(opts *boltStoreOptions) (*boltStore, error) {
 			Help:    "The distribution of message store garbage collection cycle durations in seconds.",
 			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
 		}),
+		gcBatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "message_store_gc_batches_total",
+			Help: "The total number of write transactions run by message store garbage collection cycles.",
+		}),
+		gcDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "message_store_gc_deleted_messages_total",
+			Help: "The total number of messages deleted by message store garbage collection cycles.",
+		}),
 	}
 
 	if opts.registry != nil {
@@ -88,6 +238,8 @@ func newBoltStore(opts *boltStoreOptions) (*boltStore, error) {
 		opts.registry.Register(store.totalGets)
 		opts.registry.Register(store.failedGets)
 		opts.registry.Register(store.gcDuration)
+		opts.registry.Register(store.gcBatches)
+		opts.registry.Register(store.gcDeleted)
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -95,11 +247,37 @@ func newBoltStore(opts *boltStoreOptions) (*boltStore, error) {
 		if err != nil {
 			return fmt.Errorf("error creating messages bucket: %v", err)
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTimestamps)); err != nil {
+			return fmt.Errorf("error creating timestamps bucket: %v", err)
+		}
+		for _, name := range topicIndexBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("error creating %s bucket: %v", name, err)
+			}
+		}
+		if err := indexTimestamps(tx); err != nil {
+			return fmt.Errorf("error indexing message timestamps: %v", err)
+		}
 
 		b, err := tx.CreateBucketIfNotExists([]byte(bucketMetadata))
 		if err != nil {
 			return fmt.Errorf("error creating metadata bucket: %v", err)
 		}
+		if _, err := b.CreateBucketIfNotExists([]byte(bucketTopicConfigs)); err != nil {
+			return fmt.Errorf("error creating topic configuration bucket: %v", err)
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte(bucketTopicStats)); err != nil {
+			return fmt.Errorf("error creating topic statistics bucket: %v", err)
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte(bucketTopicSequences)); err != nil {
+			return fmt.Errorf("error creating topic sequences bucket: %v", err)
+		}
+		if err := countMessages(tx); err != nil {
+			return fmt.Errorf("error counting messages: %v", err)
+		}
+		if err := rebuildAllAlerts(tx); err != nil {
+			return fmt.Errorf("error rebuilding alert states: %v", err)
+		}
 		genID := b.Get([]byte(keyGenerationID))
 		if genID == nil {
 			genID = []byte(uuid.NewV4().String())
@@ -115,6 +293,7 @@ func newBoltStore(opts *boltStoreOptions) (*boltStore, error) {
 		return nil, err
 	}
 
+	store.commits = newCommitQueue(db, opts.commitMaxDelay, opts.commitMaxSize)
 	return store, nil
 }
 
@@ -127,7 +306,7 @@ func (bs *boltStore) start() {
 			return
 		case <-gcTicker.C:
 			log.Println("Running GC cycle to remove old entries...")
-			num, err := bs.gc(time.Now().Add(-bs.options.retention))
+			num, err := bs.gc(time.Now())
 			if err != nil {
 				log.Println("Error running GC cycle:", err)
 			} else {
@@ -144,42 +323,472 @@ func keyFromIndex(index uint64) []byte {
 	return buf
 }
 
-func (bs *boltStore) append(topic string, data interface{}) error {
-	err := bs.db.Update(func(tx *bolt.Tx) error {
-		root := tx.Bucket([]byte(bucketMessages))
-		b, err := root.CreateBucketIfNotExists([]byte(topic))
+// timestampKey returns the key of a message in a topic's timestamp index. The
+// index is ordered by timestamp first, and by message index for messages with
+// identical timestamps.
+func timestampKey(ts time.Time, index uint64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:], index)
+	return buf
+}
+
+// validEventTime returns whether an event time can be indexed. Timestamp index
+// keys hold nanoseconds since the Unix epoch as unsigned integers, so times
+// before 1970 would sort after all others, and times beyond 2262 can't be
+// represented at all.
+func validEventTime(t time.Time) bool {
+	return !t.Before(time.Unix(0, 0)) && !t.After(time.Unix(0, math.MaxInt64))
+}
+
+// indexFromTimestampKey returns the message index of a timestamp index key.
+func indexFromTimestampKey(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[8:])
+}
+
+// indexTimestamps builds the timestamp and event time indexes for any topic
+// that doesn't have them yet, which is the case for topics created by older
+// versions.
+func indexTimestamps(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(bucketMessages))
+	tsRoot := tx.Bucket([]byte(bucketTimestamps))
+	etRoot := tx.Bucket([]byte(bucketEventTimes))
+
+	return root.ForEach(func(topic, _ []byte) error {
+		var tsb, etb *bolt.Bucket
+		var err error
+		if tsRoot.Bucket(topic) == nil {
+			if tsb, err = tsRoot.CreateBucket(topic); err != nil {
+				return fmt.Errorf("error creating timestamp index for topic %q: %v", topic, err)
+			}
+		}
+		if etRoot.Bucket(topic) == nil {
+			if etb, err = etRoot.CreateBucket(topic); err != nil {
+				return fmt.Errorf("error creating event time index for topic %q: %v", topic, err)
+			}
+		}
+		if tsb == nil && etb == nil {
+			return nil
+		}
+
+		return root.Bucket(topic).ForEach(func(k, v []byte) error {
+			var n Message
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("unable to unmarshal message: %v", err)
+			}
+			if tsb != nil {
+				if err := tsb.Put(timestampKey(n.Timestamp, n.Index), nil); err != nil {
+					return err
+				}
+			}
+			if etb != nil {
+				return etb.Put(timestampKey(n.eventTime(), n.Index), nil)
+			}
+			return nil
+		})
+	})
+}
+
+// topicStats tracks the number and total size of the messages in a topic.
+type topicStats struct {
+	count uint64
+	bytes uint64
+}
+
+func getTopicStats(tx *bolt.Tx, topic []byte) topicStats {
+	v := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicStats)).Get(topic)
+	if v == nil {
+		return topicStats{}
+	}
+	return topicStats{
+		count: binary.BigEndian.Uint64(v),
+		bytes: binary.BigEndian.Uint64(v[8:]),
+	}
+}
+
+func putTopicStats(tx *bolt.Tx, topic []byte, stats topicStats) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, stats.count)
+	binary.BigEndian.PutUint64(buf[8:], stats.bytes)
+	if err := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicStats)).Put(topic, buf); err != nil {
+		return fmt.Errorf("error updating statistics for topic %q: %v", topic, err)
+	}
+	return nil
+}
+
+// countMessages initializes the statistics of any topic that doesn't have them
+// yet, which is the case for topics created by older versions.
+func countMessages(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(bucketMessages))
+	statsBucket := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicStats))
+
+	return root.ForEach(func(topic, _ []byte) error {
+		if statsBucket.Get(topic) != nil {
+			return nil
+		}
+		var stats topicStats
+		root.Bucket(topic).ForEach(func(k, v []byte) error {
+			stats.count++
+			stats.bytes += uint64(len(v))
+			return nil
+		})
+		return putTopicStats(tx, topic, stats)
+	})
+}
+
+// getTopicConfig returns the configuration of a topic, or an empty
+// configuration if none has been set.
+func getTopicConfig(tx *bolt.Tx, topic []byte) (*TopicConfig, error) {
+	cfg := &TopicConfig{}
+	v := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicConfigs)).Get(topic)
+	if v == nil {
+		return cfg, nil
+	}
+	if err := json.Unmarshal(v, cfg); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal configuration of topic %q: %v", topic, err)
+	}
+	return cfg, nil
+}
+
+// createTopic creates the buckets of a topic if they don't exist yet.
+func createTopic(tx *bolt.Tx, topic []byte) (*bolt.Bucket, error) {
+	root := tx.Bucket([]byte(bucketMessages))
+	if b := root.Bucket(topic); b != nil {
+		return b, nil
+	}
+
+	b, err := root.CreateBucket(topic)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bucket for topic %q: %v", topic, err)
+	}
+	if _, err := tx.Bucket([]byte(bucketTimestamps)).CreateBucketIfNotExists(topic); err != nil {
+		return nil, fmt.Errorf("error creating timestamp index for topic %q: %v", topic, err)
+	}
+	if _, err := tx.Bucket([]byte(bucketEventTimes)).CreateBucketIfNotExists(topic); err != nil {
+		return nil, fmt.Errorf("error creating event time index for topic %q: %v", topic, err)
+	}
+
+	// Continue the index sequence of a previously deleted topic of the same name,
+	// so that clients never see an index reused within a generation.
+	if seq := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicSequences)).Get(topic); seq != nil {
+		if err := b.SetSequence(binary.BigEndian.Uint64(seq)); err != nil {
+			return nil, fmt.Errorf("error restoring sequence of topic %q: %v", topic, err)
+		}
+	}
+	return b, nil
+}
+
+// purgeMessage removes a message from a topic, its timestamp indexes, and its
+// statistics.
+func purgeMessage(tx *bolt.Tx, topic []byte, idx uint64) error {
+	b := tx.Bucket([]byte(bucketMessages)).Bucket(topic)
+	k := keyFromIndex(idx)
+	v := b.Get(k)
+	if v == nil {
+		return fmt.Errorf("message %d not found in topic %q", idx, topic)
+	}
+
+	var n Message
+	if err := json.Unmarshal(v, &n); err != nil {
+		return fmt.Errorf("unable to unmarshal message: %v", err)
+	}
+	size := uint64(len(v))
+
+	if err := untrackAlerts(tx, topic, idx, n.Data); err != nil {
+		return err
+	}
+	if err := b.Delete(k); err != nil {
+		return fmt.Errorf("unable to delete message: %v", err)
+	}
+	if err := tx.Bucket([]byte(bucketTimestamps)).Bucket(topic).Delete(timestampKey(n.Timestamp, idx)); err != nil {
+		return fmt.Errorf("unable to delete message from timestamp index: %v", err)
+	}
+	if err := tx.Bucket([]byte(bucketEventTimes)).Bucket(topic).Delete(timestampKey(n.eventTime(), idx)); err != nil {
+		return fmt.Errorf("unable to delete message from event time index: %v", err)
+	}
+	if eb := tx.Bucket([]byte(bucketExpiries)).Bucket(topic); eb != nil && n.ExpiresAt != nil {
+		if err := eb.Delete(timestampKey(*n.ExpiresAt, idx)); err != nil {
+			return fmt.Errorf("unable to delete message from expiry index: %v", err)
+		}
+	}
+
+	stats := getTopicStats(tx, topic)
+	stats.count--
+	stats.bytes -= size
+	return putTopicStats(tx, topic, stats)
+}
+
+// enforceQuota checks a topic against its quota after messages have been
+// appended to it, starting at the given index. Depending on the quota's
+// action, it either fails or purges the oldest messages that were there
+// before, until the topic is within the quota.
+func enforceQuota(tx *bolt.Tx, b *bolt.Bucket, topic []byte, cfg *TopicConfig, first uint64) error {
+	quota := cfg.Quota
+	if quota == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for !quota.allows(getTopicStats(tx, topic)) {
+		if quota.Action != quotaDropOldest {
+			return errQuotaExceeded
+		}
+		k, _ := c.First()
+		if k == nil || binary.BigEndian.Uint64(k) >= first {
+			// The appended messages alone exceed the quota.
+			return errQuotaExceeded
+		}
+		if err := purgeMessage(tx, topic, binary.BigEndian.Uint64(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openTopicForAppend returns the bucket of a topic to append to, creating the
+// topic unless strict topic creation is enabled.
+func (bs *boltStore) openTopicForAppend(tx *bolt.Tx, topic []byte) (*bolt.Bucket, error) {
+	if bs.options.strictTopics && tx.Bucket([]byte(bucketMessages)).Bucket(topic) == nil {
+		return nil, errTopicNotFound
+	}
+	return createTopic(tx, topic)
+}
+
+// checkTopicForAppend returns errTopicNotFound if strict topic creation is
+// enabled and the topic doesn't exist.
+func (bs *boltStore) checkTopicForAppend(topic string) error {
+	if !bs.options.strictTopics {
+		return nil
+	}
+	return bs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic)) == nil {
+			return errTopicNotFound
+		}
+		return nil
+	})
+}
+
+// appendMessage stores a new message in a topic bucket and updates the topic's
+// timestamp indexes and statistics. If ttl is positive, the message expires
+// after it.
+func appendMessage(tx *bolt.Tx, b *bolt.Bucket, topic []byte, n Message, ttl time.Duration) (*Message, error) {
+	idx, err := b.NextSequence()
+	if err != nil {
+		return nil, fmt.Errorf("error getting next sequence number: %v", err)
+	}
+
+	n.Index = idx
+	n.Timestamp = time.Now()
+	if ttl > 0 {
+		expiresAt := n.Timestamp.Add(ttl)
+		n.ExpiresAt = &expiresAt
+	}
+	buf, err := json.Marshal(n)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling message: %v", err)
+	}
+	if err := b.Put(keyFromIndex(idx), buf); err != nil {
+		return nil, fmt.Errorf("error appending message: %v", err)
+	}
+	if err := tx.Bucket([]byte(bucketTimestamps)).Bucket(topic).Put(timestampKey(n.Timestamp, idx), nil); err != nil {
+		return nil, fmt.Errorf("error indexing message: %v", err)
+	}
+	if err := tx.Bucket([]byte(bucketEventTimes)).Bucket(topic).Put(timestampKey(n.eventTime(), idx), nil); err != nil {
+		return nil, fmt.Errorf("error indexing message event time: %v", err)
+	}
+	if n.ExpiresAt != nil {
+		eb, err := tx.Bucket([]byte(bucketExpiries)).CreateBucketIfNotExists(topic)
 		if err != nil {
-			return fmt.Errorf("error creating bucket for topic %q: %v", topic, err)
+			return nil, fmt.Errorf("error creating expiry index for topic %q: %v", topic, err)
+		}
+		if err := eb.Put(timestampKey(*n.ExpiresAt, idx), nil); err != nil {
+			return nil, fmt.Errorf("error indexing message expiry: %v", err)
 		}
-		idx, err := b.NextSequence()
+	}
+
+	stats := getTopicStats(tx, topic)
+	stats.count++
+	stats.bytes += uint64(len(buf))
+	return &n, putTopicStats(tx, topic, stats)
+}
+
+// append stores a new message in a topic and returns it, along with whether it
+// was newly created. Topics that split Alertmanager notifications store one
+// message per alert instead. If the data is a duplicate according to the given
+// idempotency key or the topic's Alertmanager deduplication, the originally
+// appended messages are returned instead.
+func (bs *boltStore) append(topic string, data interface{}, opts appendOptions) ([]Message, bool, error) {
+	// Appends to unknown topics are rejected before they join a shared
+	// transaction, where they would make the other writes in it retry.
+	if err := bs.checkTopicForAppend(topic); err != nil {
+		bs.totalAppends.WithLabelValues(topic).Inc()
+		bs.failedAppends.WithLabelValues(topic).Inc()
+		return nil, false, err
+	}
+
+	var msgs []Message
+	var created bool
+	err := bs.commits.update(func(tx *bolt.Tx) error {
+		created = false
+		b, err := bs.openTopicForAppend(tx, []byte(topic))
 		if err != nil {
-			return fmt.Errorf("error getting next sequence number: %v", err)
+			return err
 		}
 
-		n := Message{
-			Index:     idx,
-			Timestamp: time.Now(),
-			Data:      data,
+		now := time.Now()
+		if opts.idempotencyKey != "" {
+			msgs, err = bs.lookupIdempotencyKey(tx, b, []byte(topic), opts.idempotencyKey, now)
+			if err != nil || msgs != nil {
+				return err
+			}
 		}
-		buf, err := json.Marshal(n)
+
+		cfg, err := getTopicConfig(tx, []byte(topic))
 		if err != nil {
-			return fmt.Errorf("error marshalling message: %v", err)
+			return err
 		}
-		if err := b.Put(keyFromIndex(idx), buf); err != nil {
-			return fmt.Errorf("error appending message: %v", err)
+		items := []interface{}{data}
+		var dedup *alertmanagerNotification
+		if am := cfg.Alertmanager; am != nil {
+			if notification, ok := parseAlertmanagerNotification(data); ok {
+				if am.DedupWindow > 0 {
+					msgs, err = repeatNotification(tx, b, []byte(topic), notification, time.Duration(am.DedupWindow), now)
+					if err != nil || msgs != nil {
+						return err
+					}
+					dedup = notification
+				}
+				if am.SplitAlerts && len(notification.Alerts) > 0 {
+					items = notification.splitAlerts()
+				}
+			}
+		}
+
+		msgs = make([]Message, 0, len(items))
+		for _, item := range items {
+			eventTime := opts.eventTime
+			if eventTime == nil {
+				eventTime = cfg.eventTime(item)
+			}
+			tmpl := Message{Data: item, EventTime: eventTime, Meta: opts.meta}
+			if raw, ok := item.([]byte); ok {
+				tmpl.Data = base64.StdEncoding.EncodeToString(raw)
+				tmpl.Encoding = encodingBase64
+				tmpl.ContentType = opts.contentType
+			}
+			n, err := appendMessage(tx, b, []byte(topic), tmpl, opts.ttl)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, *n)
+		}
+		created = true
+
+		if err := enforceQuota(tx, b, []byte(topic), cfg, msgs[0].Index); err != nil {
+			return err
+		}
+
+		if err := trackMessageAlerts(tx, []byte(topic), cfg, msgs); err != nil {
+			return err
+		}
+		if dedup != nil {
+			if err := putAlertGroup(tx, []byte(topic), dedup, msgs, msgs[0].Timestamp); err != nil {
+				return err
+			}
+		}
+		if opts.idempotencyKey != "" {
+			return putIdempotencyKey(tx, []byte(topic), opts.idempotencyKey, msgs)
 		}
 		return nil
 	})
 
-	bs.totalAppends.WithLabelValues(topic).Inc()
 	if err != nil {
+		bs.totalAppends.WithLabelValues(topic).Inc()
 		bs.failedAppends.WithLabelValues(topic).Inc()
+		return nil, false, err
+	}
+	bs.totalAppends.WithLabelValues(topic).Add(float64(len(msgs)))
+	if created {
+		bs.notifier.notify(topic)
+	}
+	return msgs, created, nil
+}
+
+// appendBatch atomically appends a sequence of messages to a topic in a single
+// transaction. Only the idempotency key, metadata, event time and TTL of the
+// options apply, the latter to all of the messages. If the batch is a duplicate
+// according to the idempotency key, the range of the originally appended
+// messages is returned instead.
+func (bs *boltStore) appendBatch(topic string, data []interface{}, opts appendOptions) (*BatchAppendResponse, error) {
+	resp := &BatchAppendResponse{
+		GenerationID: bs.generationID,
+	}
+	var created bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.openTopicForAppend(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		if opts.idempotencyKey != "" {
+			var ok bool
+			if _, resp.FirstIndex, resp.LastIndex, ok = bs.lookupIdempotencyRange(tx, []byte(topic), opts.idempotencyKey, time.Now()); ok {
+				return nil
+			}
+		}
+		cfg, err := getTopicConfig(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		var first, last *Message
+		for i, d := range data {
+			eventTime := opts.eventTime
+			if eventTime == nil {
+				eventTime = cfg.eventTime(d)
+			}
+			n, err := appendMessage(tx, b, []byte(topic), Message{Data: d, EventTime: eventTime, Meta: opts.meta}, opts.ttl)
+			if err != nil {
+				return err
+			}
+			if err := trackMessageAlerts(tx, []byte(topic), cfg, []Message{*n}); err != nil {
+				return err
+			}
+			if i == 0 {
+				first = n
+			}
+			last = n
+		}
+		resp.FirstIndex, resp.LastIndex = first.Index, last.Index
+		created = true
+		if err := enforceQuota(tx, b, []byte(topic), cfg, resp.FirstIndex); err != nil {
+			return err
+		}
+		if opts.idempotencyKey != "" {
+			return putIdempotencyKey(tx, []byte(topic), opts.idempotencyKey, []Message{*first, *last})
+		}
+		return nil
+	})
+
+	bs.totalAppends.WithLabelValues(topic).Add(float64(len(data)))
+	if err != nil {
+		bs.failedAppends.WithLabelValues(topic).Add(float64(len(data)))
+		return nil, err
+	}
+	if created {
+		bs.notifier.notify(topic)
 	}
-	return err
+	return resp, nil
 }
 
-func (bs *boltStore) get(topic string, generationID string, fromIndex uint64) (*MessagesResponse, error) {
+// get returns the messages of a topic selected by the given query. If the
+// query's limit is reached, the response indicates that more messages are
+// available. Expired messages are skipped.
+func (bs *boltStore) get(topic string, q messageQuery) (*MessagesResponse, error) {
 	ns := []Message{}
+	var hasMore bool
+	if q.generationID != bs.generationID {
+		q.fromIndex = 0
+	}
+	nextIndex := q.fromIndex
+	now := time.Now()
 	err := bs.db.View(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte(bucketMessages))
 		b := root.Bucket([]byte(topic))
@@ -187,22 +796,34 @@ func (bs *boltStore) get(topic string, generationID string, fromIndex uint64) (*
 			// Topic doesn't exist yet, return it as an empty set.
 			return nil
 		}
-		c := b.Cursor()
 
-		var k, v []byte
-		if generationID == bs.generationID {
-			k, v = c.Seek(keyFromIndex(fromIndex))
-		} else {
-			k, v = c.First()
+		if q.hasTimeRange() {
+			var err error
+			ns, nextIndex, hasMore, err = getTimeRange(tx, b, topic, q, now)
+			return err
 		}
 
-		var n Message
-		for ; k != nil; k, v = c.Next() {
+		c := b.Cursor()
+		for k, v := c.Seek(keyFromIndex(q.fromIndex)); k != nil; k, v = c.Next() {
+			var n Message
 			if err := json.Unmarshal(v, &n); err != nil {
 				return fmt.Errorf("unable to unmarshal message: %v", err)
 			}
+			if n.expired(now) || !matchData(q.matchers, n.Data) {
+				// Skip expired and non-matching messages for good.
+				nextIndex = n.Index + 1
+				continue
+			}
+			if q.limit > 0 && len(ns) == q.limit {
+				hasMore = true
+				break
+			}
 
+			if q.fields != nil {
+				n.Data = projectFields(n.Data, q.fields)
+			}
 			ns = append(ns, n)
+			nextIndex = n.Index + 1
 		}
 		return nil
 	})
@@ -214,51 +835,479 @@ func (bs *boltStore) get(topic string, generationID string, fromIndex uint64) (*
 		return nil, err
 	}
 
+	if !bs.options.exposeMeta {
+		for i := range ns {
+			ns[i].Meta = nil
+		}
+	}
 	return &MessagesResponse{
 		GenerationID: bs.generationID,
 		Messages:     ns,
+		NextIndex:    nextIndex,
+		HasMore:      hasMore,
+	}, nil
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// getTimeRange returns the messages of a topic bucket that match the query's
+// time range, using the topic's timestamp or event time index to find them.
+// Messages that have expired at the given time are skipped.
+//
+// Timestamps are not guaranteed to be in index order, so all of the index
+// within the time range is scanned for every page, and the matching indexes
+// from the query's fromIndex on are collected and then sorted.
+func getTimeRange(tx *bolt.Tx, b *bolt.Bucket, topic string, q messageQuery, now time.Time) ([]Message, uint64, bool, error) {
+	ns := []Message{}
+	nextIndex := q.fromIndex
+	index := bucketTimestamps
+	if q.eventTime {
+		index = bucketEventTimes
+	}
+	tsb := tx.Bucket([]byte(index)).Bucket([]byte(topic))
+	if tsb == nil {
+		return ns, nextIndex, false, nil
+	}
+
+	var idxs uint64Slice
+	c := tsb.Cursor()
+	k, _ := c.First()
+	if q.since.After(time.Unix(0, 0)) {
+		k, _ = c.Seek(timestampKey(q.since, 0))
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if !q.until.IsZero() && int64(binary.BigEndian.Uint64(k)) > q.until.UnixNano() {
+			break
+		}
+		if idx := indexFromTimestampKey(k); idx >= q.fromIndex {
+			idxs = append(idxs, idx)
+		}
+	}
+	sort.Sort(idxs)
+
+	for _, idx := range idxs {
+		v := b.Get(keyFromIndex(idx))
+		if v == nil {
+			return nil, 0, false, fmt.Errorf("indexed message %d not found", idx)
+		}
+		var n Message
+		if err := json.Unmarshal(v, &n); err != nil {
+			return nil, 0, false, fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		if n.expired(now) || !matchData(q.matchers, n.Data) {
+			nextIndex = idx + 1
+			continue
+		}
+		if q.limit > 0 && len(ns) == q.limit {
+			return ns, nextIndex, true, nil
+		}
+		if q.fields != nil {
+			n.Data = projectFields(n.Data, q.fields)
+		}
+		ns = append(ns, n)
+		nextIndex = idx + 1
+	}
+	return ns, nextIndex, false, nil
+}
+
+// getMessageRange returns the messages of a topic bucket from the first to the
+// last index. Messages that have been purged since are returned without data,
+// with the given fallback timestamp.
+func getMessageRange(b *bolt.Bucket, first, last uint64, fallback time.Time) ([]Message, error) {
+	msgs := make([]Message, 0, last-first+1)
+	for idx := first; idx <= last; idx++ {
+		v := b.Get(keyFromIndex(idx))
+		if v == nil {
+			msgs = append(msgs, Message{Index: idx, Timestamp: fallback})
+			continue
+		}
+		var n Message
+		if err := json.Unmarshal(v, &n); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		msgs = append(msgs, n)
+	}
+	return msgs, nil
+}
+
+// getMessage returns a single message of a topic. Expired messages are not
+// found.
+func (bs *boltStore) getMessage(topic string, index uint64) (*Message, error) {
+	var n Message
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic))
+		if b == nil {
+			return errTopicNotFound
+		}
+		v := b.Get(keyFromIndex(index))
+		if v == nil {
+			return errMessageNotFound
+		}
+		if err := json.Unmarshal(v, &n); err != nil {
+			return fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		if n.expired(time.Now()) {
+			return errMessageNotFound
+		}
+		return nil
+	})
+
+	bs.totalGets.WithLabelValues(topic).Inc()
+	if err != nil {
+		if err != errTopicNotFound && err != errMessageNotFound {
+			bs.failedGets.WithLabelValues(topic).Inc()
+		}
+		return nil, err
+	}
+	if !bs.options.exposeMeta {
+		n.Meta = nil
+	}
+	return &n, nil
+}
+
+// deleteMessage replaces a message with a tombstone that retains its index and
+// timestamp, but none of its data. The tombstone is purged by GC like the
+// original message would have been. Deletion watches of the topic are passed
+// the original message.
+func (bs *boltStore) deleteMessage(topic string, index uint64) error {
+	var deleted *Message
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		deleted = nil
+		b := tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic))
+		if b == nil {
+			return errTopicNotFound
+		}
+		k := keyFromIndex(index)
+		v := b.Get(k)
+		if v == nil {
+			return errMessageNotFound
+		}
+		oldSize := uint64(len(v))
+
+		var n Message
+		if err := json.Unmarshal(v, &n); err != nil {
+			return fmt.Errorf("unable to unmarshal message: %v", err)
+		}
+		if n.Deleted {
+			return nil
+		}
+		if err := untrackAlerts(tx, []byte(topic), index, n.Data); err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(n.tombstone())
+		if err != nil {
+			return fmt.Errorf("error marshalling tombstone: %v", err)
+		}
+		if err := b.Put(k, buf); err != nil {
+			return fmt.Errorf("error storing tombstone: %v", err)
+		}
+
+		stats := getTopicStats(tx, []byte(topic))
+		stats.bytes = stats.bytes - oldSize + uint64(len(buf))
+		deleted = &n
+		return putTopicStats(tx, []byte(topic), stats)
+	})
+	if err != nil {
+		return err
+	}
+	if deleted != nil {
+		bs.notifier.notifyDeleted(topic, *deleted)
+	}
+	return nil
+}
+
+func (bs *boltStore) wait(topic string) (<-chan struct{}, func()) {
+	return bs.notifier.wait(topic)
+}
+
+func (bs *boltStore) watchDeletions(topic string) (*deletionWatch, func()) {
+	return bs.notifier.watchDeletions(topic)
+}
+
+func (bs *boltStore) generation() string {
+	return bs.generationID
+}
+
+// setTopicConfig stores the configuration of a topic, creating the topic if it
+// doesn't exist yet. It returns whether the topic was created.
+func (bs *boltStore) setTopicConfig(topic string, cfg *TopicConfig) (bool, error) {
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling topic configuration: %v", err)
+	}
+	var created bool
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		created = tx.Bucket([]byte(bucketMessages)).Bucket([]byte(topic)) == nil
+		if _, err := createTopic(tx, []byte(topic)); err != nil {
+			return err
+		}
+		oldCfg, err := getTopicConfig(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicConfigs)).Put([]byte(topic), buf); err != nil {
+			return fmt.Errorf("error storing configuration of topic %q: %v", topic, err)
+		}
+		if (oldCfg.Alertmanager == nil) != (cfg.Alertmanager == nil) {
+			return rebuildAlerts(tx, []byte(topic), cfg)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// topicConfig returns the configuration of a topic. Topics that don't exist
+// have the default configuration.
+func (bs *boltStore) topicConfig(topic string) (*TopicConfig, error) {
+	var cfg *TopicConfig
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cfg, err = getTopicConfig(tx, []byte(topic))
+		return err
+	})
+	return cfg, err
+}
+
+// listTopics returns information about all existing topics, ordered by name.
+func (bs *boltStore) listTopics() (*TopicsResponse, error) {
+	topics := []TopicInfo{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketMessages))
+		tsRoot := tx.Bucket([]byte(bucketTimestamps))
+
+		return root.ForEach(func(topic, _ []byte) error {
+			cfg, err := getTopicConfig(tx, topic)
+			if err != nil {
+				return err
+			}
+			stats := getTopicStats(tx, topic)
+			info := TopicInfo{
+				Name:     string(topic),
+				Messages: stats.count,
+				Bytes:    stats.bytes,
+				Config:   *cfg,
+			}
+
+			c := root.Bucket(topic).Cursor()
+			if k, _ := c.First(); k != nil {
+				info.FirstIndex = binary.BigEndian.Uint64(k)
+			}
+			if k, _ := c.Last(); k != nil {
+				info.LastIndex = binary.BigEndian.Uint64(k)
+			}
+
+			tsC := tsRoot.Bucket(topic).Cursor()
+			if k, _ := tsC.First(); k != nil {
+				ts := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+				info.OldestTimestamp = &ts
+			}
+			if k, _ := tsC.Last(); k != nil {
+				ts := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+				info.NewestTimestamp = &ts
+			}
+
+			topics = append(topics, info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TopicsResponse{
+		GenerationID: bs.generationID,
+		Topics:       topics,
 	}, nil
 }
 
-func (bs *boltStore) gc(olderThan time.Time) (int, error) {
+// deleteTopic drops a topic with all of its messages and settings.
+func (bs *boltStore) deleteTopic(topic string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketMessages))
+		b := root.Bucket([]byte(topic))
+		if b == nil {
+			return errTopicNotFound
+		}
+
+		meta := tx.Bucket([]byte(bucketMetadata))
+		if err := meta.Bucket([]byte(bucketTopicSequences)).Put([]byte(topic), keyFromIndex(b.Sequence())); err != nil {
+			return fmt.Errorf("error storing sequence of topic %q: %v", topic, err)
+		}
+
+		if err := root.DeleteBucket([]byte(topic)); err != nil {
+			return fmt.Errorf("error deleting bucket for topic %q: %v", topic, err)
+		}
+		if err := tx.Bucket([]byte(bucketTimestamps)).DeleteBucket([]byte(topic)); err != nil {
+			return fmt.Errorf("error deleting timestamp index for topic %q: %v", topic, err)
+		}
+		for _, name := range topicIndexBuckets {
+			indexes := tx.Bucket([]byte(name))
+			if indexes.Bucket([]byte(topic)) == nil {
+				continue
+			}
+			if err := indexes.DeleteBucket([]byte(topic)); err != nil {
+				return fmt.Errorf("error deleting %s of topic %q: %v", name, topic, err)
+			}
+		}
+		if err := meta.Bucket([]byte(bucketTopicConfigs)).Delete([]byte(topic)); err != nil {
+			return fmt.Errorf("error deleting configuration of topic %q: %v", topic, err)
+		}
+		if err := meta.Bucket([]byte(bucketTopicStats)).Delete([]byte(topic)); err != nil {
+			return fmt.Errorf("error deleting statistics of topic %q: %v", topic, err)
+		}
+		return nil
+	})
+}
+
+// gc purges the messages of all topics that have expired or violate their
+// topic's retention policy at the given time.
+func (bs *boltStore) gc(now time.Time) (int, error) {
 	start := time.Now()
 	defer func() {
 		bs.gcDuration.Observe(float64(time.Since(start).Seconds()))
 	}()
 
+	numDeleted, err := bs.inBatches(func(limit int) (int, error) {
+		return bs.gcBatch(now, limit)
+	})
+	if err != nil {
+		return numDeleted, err
+	}
+	if _, err := bs.inBatches(func(limit int) (int, error) {
+		return bs.gcIdempotencyKeys(now, limit)
+	}); err != nil {
+		return numDeleted, err
+	}
+	if _, err := bs.inBatches(func(limit int) (int, error) {
+		return bs.gcAlertGroups(now, limit)
+	}); err != nil {
+		return numDeleted, err
+	}
+	return numDeleted, nil
+}
+
+// inBatches repeatedly calls a GC function that deletes up to the configured
+// batch size of entries in one transaction, until there is nothing left to
+// delete. It returns the total number of deleted entries.
+func (bs *boltStore) inBatches(gcFn func(limit int) (int, error)) (int, error) {
 	var numDeleted int
-	return numDeleted, bs.db.Update(func(tx *bolt.Tx) error {
+	for {
+		num, err := gcFn(bs.options.gcBatchSize)
+		numDeleted += num
+		if err != nil {
+			return numDeleted, err
+		}
+		if bs.options.gcBatchSize <= 0 || num < bs.options.gcBatchSize {
+			return numDeleted, nil
+		}
+
+		// Give waiting appends a chance to run, and don't hold up shutdown.
+		select {
+		case <-bs.stop:
+			return numDeleted, nil
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+// gcBatch deletes up to limit messages that have expired or violate retention
+// policies in a single write transaction. A non-positive limit deletes all of
+// them.
+func (bs *boltStore) gcBatch(now time.Time, limit int) (int, error) {
+	var numDeleted int
+	err := bs.db.Update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte(bucketMessages))
 		rootC := root.Cursor()
 
 		for topic, _ := rootC.First(); topic != nil; topic, _ = rootC.Next() {
-			c := root.Bucket(topic).Cursor()
-
-			// For now, this goes through all entries and doesn't abort after the first
-			// encountered entry that should be kept, just in case there are time/date
-			// glitches on a machine and timestamps end up being out of order.
-			//
-			// TODO: Possibly reconsider this for performance reasons if the DB gets huge.
-			var n Message
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				if err := json.Unmarshal(v, &n); err != nil {
-					return fmt.Errorf("unable to unmarshal message: %v", err)
-				}
+			cfg, err := getTopicConfig(tx, topic)
+			if err != nil {
+				return err
+			}
+			policy := cfg.Retention
+			maxAge := bs.options.retention
+			if policy.MaxAge > 0 {
+				maxAge = time.Duration(policy.MaxAge)
+			}
+			olderThan := now.Add(-maxAge)
+			index := bucketTimestamps
+			if policy.TimeBasis == timeBasisEvent {
+				index = bucketEventTimes
+			}
 
-				if n.Timestamp.Before(olderThan) {
-					if err := c.Delete(); err != nil {
-						return fmt.Errorf("unable to delete message: %v", err)
+			// Messages whose TTL has passed are purged regardless of the
+			// retention policy.
+			if eb := tx.Bucket([]byte(bucketExpiries)).Bucket(topic); eb != nil {
+				eC := eb.Cursor()
+				for k, _ := eC.First(); k != nil; k, _ = eC.First() {
+					if limit > 0 && numDeleted == limit {
+						return nil
+					}
+					if int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+						break
+					}
+					if err := purgeMessage(tx, topic, indexFromTimestampKey(k)); err != nil {
+						return err
 					}
 					numDeleted++
 				}
 			}
+
+			// The timestamp index is ordered by time, so all expired messages are at
+			// its beginning, even if time/date glitches on a machine caused their
+			// timestamps to be out of index order. This allows us to stop at the
+			// first message that should be kept without looking at any others.
+			tsC := tx.Bucket([]byte(index)).Bucket(topic).Cursor()
+			for k, _ := tsC.First(); k != nil; k, _ = tsC.First() {
+				if limit > 0 && numDeleted == limit {
+					return nil
+				}
+				if int64(binary.BigEndian.Uint64(k)) >= olderThan.UnixNano() {
+					break
+				}
+				if err := purgeMessage(tx, topic, indexFromTimestampKey(k)); err != nil {
+					return err
+				}
+				numDeleted++
+			}
+
+			// Size limits are enforced by deleting the messages with the lowest
+			// indexes first.
+			c := root.Bucket(topic).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.First() {
+				stats := getTopicStats(tx, topic)
+				if (policy.MaxMessages == 0 || stats.count <= policy.MaxMessages) &&
+					(policy.MaxBytes == 0 || stats.bytes <= policy.MaxBytes) {
+					break
+				}
+				if limit > 0 && numDeleted == limit {
+					return nil
+				}
+				if err := purgeMessage(tx, topic, binary.BigEndian.Uint64(k)); err != nil {
+					return err
+				}
+				numDeleted++
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	bs.gcBatches.Inc()
+	bs.gcDeleted.Add(float64(numDeleted))
+	return numDeleted, nil
 }
 
 func (bs *boltStore) close() error {
 	close(bs.stop)
 	<-bs.done
+	bs.commits.close()
 	return bs.db.Close()
 }
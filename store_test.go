@@ -1,21 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
-func newTestBoltStore(t *testing.T) (store *boltStore, close func()) {
+func newTestBoltStore(t testing.TB) (store *boltStore, close func()) {
 	dir, err := ioutil.TempDir("", "bolt_store_test_")
 	if err != nil {
 		t.Fatal(err)
@@ -43,10 +52,10 @@ func TestBoltStoreMessageOrderingRegression(t *testing.T) {
 	defer close()
 
 	for i := 1; i < 100; i++ {
-		store.append("testtopic", nil)
+		store.append("testtopic", nil, appendOptions{})
 	}
 
-	msgs, err := store.get("testtopic", "", 0)
+	msgs, err := store.get("testtopic", messageQuery{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,27 +73,27 @@ func TestStoreMetrics(t *testing.T) {
 	defer close()
 
 	for i := 0; i < 5; i++ {
-		if err := store.append("topicA", nil); err != nil {
+		if _, _, err := store.append("topicA", nil, appendOptions{}); err != nil {
 			t.Fatal(err)
 		}
 	}
 	for i := 0; i < 10; i++ {
-		if err := store.append("topicB", nil); err != nil {
+		if _, _, err := store.append("topicB", nil, appendOptions{}); err != nil {
 			t.Fatal(err)
 		}
 	}
 	for i := 0; i < 15; i++ {
-		if _, err := store.get("topicA", "", 0); err != nil {
+		if _, err := store.get("topicA", messageQuery{}); err != nil {
 			t.Fatal(err)
 		}
 	}
 	for i := 0; i < 20; i++ {
-		if _, err := store.get("topicB", "", 0); err != nil {
+		if _, err := store.get("topicB", messageQuery{}); err != nil {
 			t.Fatal(err)
 		}
 	}
 	for i := 0; i < 10; i++ {
-		if _, err := store.gc(time.Now().Add(-time.Hour)); err != nil {
+		if _, err := store.gc(time.Now()); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -116,3 +125,1414 @@ func TestStoreMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestBoltStoreWaitNotifiesOnAppend(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	appendedA, _ := store.wait("topicA")
+	appendedB, stopWaitingB := store.wait("topicB")
+
+	if _, _, err := store.append("topicA", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-appendedA:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for append notification")
+	}
+
+	select {
+	case <-appendedB:
+		t.Fatal("unexpected append notification for unrelated topic")
+	default:
+	}
+
+	// Topics are forgotten once nobody waits for them anymore.
+	stopWaitingB()
+	store.notifier.mtx.Lock()
+	defer store.notifier.mtx.Unlock()
+	if len(store.notifier.waiters) != 0 {
+		t.Fatalf("unexpected waiters left: %v", store.notifier.waiters)
+	}
+}
+
+func TestBoltStoreGetLimit(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := store.append("testtopic", i, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []uint64
+	var pages int
+	idx := uint64(0)
+	for {
+		msgs, err := store.get("testtopic", messageQuery{
+			generationID: store.generationID,
+			fromIndex:    idx,
+			limit:        4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		if len(msgs.Messages) > 4 {
+			t.Fatalf("got more messages than the limit: %d", len(msgs.Messages))
+		}
+		for _, msg := range msgs.Messages {
+			got = append(got, msg.Index)
+		}
+		idx = msgs.NextIndex
+		if !msgs.HasMore {
+			break
+		}
+	}
+
+	if pages != 3 {
+		t.Fatalf("unexpected number of pages; want 3, got %d", pages)
+	}
+	for i, idx := range got {
+		if idx != uint64(i+1) {
+			t.Fatalf("unexpected message index; want %d, got %d", i+1, idx)
+		}
+	}
+	if len(got) != 10 {
+		t.Fatalf("unexpected number of messages; want 10, got %d", len(got))
+	}
+}
+
+func TestBoltStoreGetTimeRange(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	var bounds []time.Time
+	for i := 0; i < 9; i++ {
+		if i%3 == 0 {
+			bounds = append(bounds, time.Now())
+			time.Sleep(time.Millisecond)
+		}
+		if _, _, err := store.append("testtopic", i, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(q messageQuery, want ...uint64) {
+		msgs, err := store.get("testtopic", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, msg := range msgs.Messages {
+			got = append(got, msg.Index)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected messages for query %+v; want %v, got %v", q, want, got)
+		}
+	}
+
+	check(messageQuery{since: bounds[1], until: bounds[2]}, 4, 5, 6)
+	check(messageQuery{since: bounds[2]}, 7, 8, 9)
+	check(messageQuery{until: bounds[1]}, 1, 2, 3)
+	check(messageQuery{generationID: store.generationID, fromIndex: 5, since: bounds[1], until: bounds[2]}, 5, 6)
+	check(messageQuery{since: bounds[1], limit: 2}, 4, 5)
+
+	// Rebuilding the index for topics that lack one must yield the same results.
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(bucketTimestamps)).DeleteBucket([]byte("testtopic")); err != nil {
+			return err
+		}
+		return indexTimestamps(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(messageQuery{since: bounds[1], until: bounds[2]}, 4, 5, 6)
+}
+
+// appendWithTimestamp stores a message with the given timestamp, bypassing the
+// store's clock.
+func appendWithTimestamp(t *testing.T, store *boltStore, topic string, ts time.Time) {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b, err := createTopic(tx, []byte(topic))
+		if err != nil {
+			return err
+		}
+		idx, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(Message{Index: idx, Timestamp: ts})
+		if err != nil {
+			return err
+		}
+		if err := b.Put(keyFromIndex(idx), buf); err != nil {
+			return err
+		}
+		for _, index := range []string{bucketTimestamps, bucketEventTimes} {
+			if err := tx.Bucket([]byte(index)).Bucket([]byte(topic)).Put(timestampKey(ts, idx), nil); err != nil {
+				return err
+			}
+		}
+		stats := getTopicStats(tx, []byte(topic))
+		stats.count++
+		stats.bytes += uint64(len(buf))
+		return putTopicStats(tx, []byte(topic), stats)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreGCWithClockSkew(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	now := time.Now()
+	// Timestamps that are out of index order must not stop the GC early.
+	for _, age := range []time.Duration{3, 1, 4, 1, 5, 9, 2, 6} {
+		appendWithTimestamp(t, store, "testtopic", now.Add(-age*time.Hour))
+	}
+
+	num, err := store.gc(now.Add(-2*time.Hour - time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 4 {
+		t.Fatalf("unexpected number of deleted messages; want 4, got %d", num)
+	}
+
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint64
+	for _, msg := range msgs.Messages {
+		got = append(got, msg.Index)
+	}
+	if want := []uint64{1, 2, 4, 7}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected remaining messages; want %v, got %v", want, got)
+	}
+}
+
+func TestBoltStoreGCDoesNotBlockAppends(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+	store.options.gcBatchSize = 10
+
+	store.db.NoSync = true
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2000; i++ {
+		appendWithTimestamp(t, store, "oldtopic", old)
+	}
+	store.db.NoSync = false
+
+	gcBatches := func() float64 {
+		var m dto.Metric
+		if err := store.gcBatches.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	gcDone := make(chan int)
+	go func() {
+		num, err := store.gc(time.Now())
+		if err != nil {
+			t.Error(err)
+		}
+		gcDone <- num
+	}()
+
+	for gcBatches() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := store.append("newtopic", i, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-gcDone:
+		t.Fatal("GC finished before appends could complete")
+	default:
+	}
+
+	if num := <-gcDone; num != 2000 {
+		t.Fatalf("unexpected number of deleted messages; want 2000, got %d", num)
+	}
+	if batches := gcBatches(); batches < 200 {
+		t.Fatalf("unexpected number of GC batches; want at least 200, got %v", batches)
+	}
+}
+
+func TestBoltStoreGCRetentionPolicies(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	policies := map[string]RetentionPolicy{
+		"long":     {MaxAge: Duration(7 * 24 * time.Hour)},
+		"count":    {MaxMessages: 3},
+		"size":     {MaxBytes: 1},
+		"defaults": {},
+	}
+	now := time.Now()
+	for topic, policy := range policies {
+		if _, err := store.setTopicConfig(topic, &TopicConfig{Retention: policy}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			appendWithTimestamp(t, store, topic, now.Add(-2*time.Hour))
+		}
+		for i := 0; i < 5; i++ {
+			appendWithTimestamp(t, store, topic, now)
+		}
+	}
+
+	if _, err := store.gc(now); err != nil {
+		t.Fatal(err)
+	}
+
+	wantRemaining := map[string][]uint64{
+		"long":     {1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		"count":    {8, 9, 10},
+		"size":     nil,
+		"defaults": {6, 7, 8, 9, 10},
+	}
+	for topic, want := range wantRemaining {
+		msgs, err := store.get(topic, messageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, msg := range msgs.Messages {
+			got = append(got, msg.Index)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected remaining messages in topic %q; want %v, got %v", topic, want, got)
+		}
+	}
+
+	// The incrementally maintained statistics must match a full recount.
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		for topic := range policies {
+			stats := getTopicStats(tx, []byte(topic))
+			if err := tx.Bucket([]byte(bucketMetadata)).Bucket([]byte(bucketTopicStats)).Delete([]byte(topic)); err != nil {
+				return err
+			}
+			if err := countMessages(tx); err != nil {
+				return err
+			}
+			if recounted := getTopicStats(tx, []byte(topic)); recounted != stats {
+				t.Fatalf("unexpected statistics for topic %q; want %+v, got %+v", topic, recounted, stats)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreTopicManagement(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	cfg := &TopicConfig{Retention: RetentionPolicy{MaxMessages: 10}}
+	created, err := store.setTopicConfig("topicA", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected topic to be created")
+	}
+	if created, err = store.setTopicConfig("topicA", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Fatal("expected existing topic to be updated")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := store.append("topicA", i, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.append("topicB", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	topics, err := store.listTopics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics.Topics) != 2 {
+		t.Fatalf("unexpected number of topics; want 2, got %d", len(topics.Topics))
+	}
+	info := topics.Topics[0]
+	if info.Name != "topicA" || info.Messages != 3 || info.FirstIndex != 1 || info.LastIndex != 3 {
+		t.Fatalf("unexpected topic info: %+v", info)
+	}
+	if info.OldestTimestamp == nil || info.NewestTimestamp == nil || info.NewestTimestamp.Before(*info.OldestTimestamp) {
+		t.Fatalf("unexpected topic timestamps: %v, %v", info.OldestTimestamp, info.NewestTimestamp)
+	}
+	if info.Bytes == 0 || info.Config != *cfg {
+		t.Fatalf("unexpected topic info: %+v", info)
+	}
+
+	if err := store.deleteTopic("topicA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.deleteTopic("topicA"); err != errTopicNotFound {
+		t.Fatalf("unexpected error deleting missing topic: %v", err)
+	}
+
+	// A recreated topic must not reuse the indexes of the deleted one.
+	if _, _, err := store.append("topicA", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := store.get("topicA", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 1 || msgs.Messages[0].Index != 4 {
+		t.Fatalf("unexpected messages in recreated topic: %v", msgs.Messages)
+	}
+
+	store.options.strictTopics = true
+	if _, _, err := store.append("topicC", nil, appendOptions{}); err != errTopicNotFound {
+		t.Fatalf("unexpected error appending to unknown topic in strict mode: %v", err)
+	}
+	if _, _, err := store.append("topicA", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreAppendBatch(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, _, err := store.append("testtopic", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := store.appendBatch("testtopic", []interface{}{1, 2, 3}, appendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GenerationID != store.generationID || resp.FirstIndex != 2 || resp.LastIndex != 4 {
+		t.Fatalf("unexpected batch append response: %+v", resp)
+	}
+
+	// A batch that fails part-way must not leave any of its messages behind.
+	if _, err := store.appendBatch("testtopic", []interface{}{5, math.Inf(1)}, appendOptions{}); err == nil {
+		t.Fatal("expected error appending unmarshallable message")
+	}
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 4 {
+		t.Fatalf("unexpected number of messages; want 4, got %d", len(msgs.Messages))
+	}
+}
+
+func TestBoltStoreConcurrentAppends(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+	store.options.strictTopics = true
+	if _, err := store.setTopicConfig("testtopic", &TopicConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	// Writing the setting here happens before any append reaches the commit
+	// queue's goroutine.
+	store.commits.maxSize = 100
+
+	var wg sync.WaitGroup
+	for p := 0; p < 50; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, _, err := store.append("testtopic", p*20+i, appendOptions{}); err != nil {
+					t.Error(err)
+				}
+				// Failing appends that share a transaction with successful ones
+				// must not affect them.
+				if _, _, err := store.append("unknowntopic", nil, appendOptions{}); err != errTopicNotFound {
+					t.Errorf("unexpected error appending to unknown topic: %v", err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[float64]bool{}
+	for i, msg := range msgs.Messages {
+		if msg.Index != uint64(i+1) {
+			t.Fatalf("unexpected message index; want %d, got %d", i+1, msg.Index)
+		}
+		seen[msg.Data.(float64)] = true
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("unexpected number of distinct messages; want 1000, got %d", len(seen))
+	}
+}
+
+func TestCommitQueueFailingWrite(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	errFailed := errors.New("failed")
+	calls := make([]int, 4)
+	var reqs []*commitRequest
+	for i := range calls {
+		i := i
+		reqs = append(reqs, &commitRequest{
+			fn: func(tx *bolt.Tx) error {
+				calls[i]++
+				if i == 1 {
+					return errFailed
+				}
+				b, err := tx.CreateBucketIfNotExists([]byte("test"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte{byte(i)}, nil)
+			},
+			err: make(chan error, 1),
+		})
+	}
+	store.commits.commit(reqs)
+
+	for i, req := range reqs {
+		var want error
+		if i == 1 {
+			want = errFailed
+		}
+		if err := <-req.err; err != want {
+			t.Fatalf("unexpected error of write %d; want %v, got %v", i, want, err)
+		}
+	}
+	// Only the writes before the failing one are run again, along with the
+	// ones after it.
+	if want := []int{2, 1, 1, 1}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("unexpected number of calls; want %v, got %v", want, calls)
+	}
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("test")).Stats().KeyN; n != 3 {
+			t.Fatalf("unexpected number of committed writes; want 3, got %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreDeleteMessage(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := store.append("testtopic", map[string]interface{}{"secret": "hunter2"}, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.deleteMessage("testtopic", 2); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting a tombstone again is a no-op.
+	if err := store.deleteMessage("testtopic", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.deleteMessage("testtopic", 4); err != errMessageNotFound {
+		t.Fatalf("unexpected error deleting missing message: %v", err)
+	}
+	if err := store.deleteMessage("unknowntopic", 1); err != errTopicNotFound {
+		t.Fatalf("unexpected error deleting message of missing topic: %v", err)
+	}
+
+	msg, err := store.getMessage("testtopic", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Index != 2 || !msg.Deleted || msg.Data != nil || msg.Timestamp.IsZero() {
+		t.Fatalf("unexpected tombstone: %+v", msg)
+	}
+	if msg, err = store.getMessage("testtopic", 3); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Index != 3 || msg.Deleted || msg.Data == nil {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// Paging clients see the tombstone in sequence.
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 3 || !msgs.Messages[1].Deleted || msgs.Messages[0].Deleted {
+		t.Fatalf("unexpected messages: %+v", msgs.Messages)
+	}
+}
+
+func BenchmarkBoltStoreAppend(b *testing.B) {
+	for _, producers := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("producers=%d", producers), func(b *testing.B) {
+			store, closeStore := newTestBoltStore(b)
+			defer closeStore()
+			// Writing the setting here happens before any append reaches the
+			// commit queue's goroutine.
+			store.commits.maxSize = 1000
+
+			var wg sync.WaitGroup
+			work := make(chan int)
+			for p := 0; p < producers; p++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range work {
+						if _, _, err := store.append("testtopic", i, appendOptions{}); err != nil {
+							b.Error(err)
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				work <- i
+			}
+			close(work)
+			wg.Wait()
+		})
+	}
+}
+
+func TestBoltStoreIdempotentAppend(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+	store.options.idempotencyWindow = time.Hour
+
+	first, created, err := store.append("testtopic", "a", appendOptions{idempotencyKey: "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected first append to create a message")
+	}
+
+	dup, created, err := store.append("testtopic", "b", appendOptions{idempotencyKey: "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || len(dup) != 1 || dup[0].Index != first[0].Index || dup[0].Data != "a" {
+		t.Fatalf("expected duplicate append to return original message %+v, got %+v (created: %v)", first, dup, created)
+	}
+
+	// Keys are scoped to topics.
+	if _, created, err = store.append("othertopic", "c", appendOptions{idempotencyKey: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected append to another topic to create a message")
+	}
+
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 1 {
+		t.Fatalf("unexpected number of messages; want 1, got %d", len(msgs.Messages))
+	}
+
+	// Once the key has expired, appending with it creates a new message.
+	if _, err := store.gc(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, created, err = store.append("testtopic", "d", appendOptions{idempotencyKey: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected append with expired key to create a message")
+	}
+}
+
+func TestBoltStoreIdempotentAppendBatch(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+	store.options.idempotencyWindow = time.Hour
+
+	resp, err := store.appendBatch("testtopic", []interface{}{"a", "b", "c"}, appendOptions{idempotencyKey: "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A retried batch returns the original range without being stored again.
+	dup, err := store.appendBatch("testtopic", []interface{}{"a", "b", "c"}, appendOptions{idempotencyKey: "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dup != *resp || dup.FirstIndex != 1 || dup.LastIndex != 3 {
+		t.Fatalf("expected duplicate batch to return original range %+v, got %+v", resp, dup)
+	}
+
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 3 {
+		t.Fatalf("unexpected number of messages; want 3, got %d", len(msgs.Messages))
+	}
+}
+
+func TestBoltStoreAlertmanagerDedup(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, err := store.setTopicConfig("alerts", &TopicConfig{
+		Alertmanager: &AlertmanagerConfig{DedupWindow: Duration(time.Hour)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	notification := func(status string, alertnames ...string) interface{} {
+		alerts := []interface{}{}
+		for _, name := range alertnames {
+			alerts = append(alerts, map[string]interface{}{
+				"status": status,
+				"labels": map[string]interface{}{"alertname": name},
+			})
+		}
+		return map[string]interface{}{
+			"version":  "4",
+			"groupKey": "{}:{}",
+			"status":   status,
+			"alerts":   alerts,
+		}
+	}
+
+	appendNotification := func(data interface{}, wantCreated bool) Message {
+		msgs, created, err := store.append("alerts", data, appendOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("unexpected number of messages; want 1, got %d", len(msgs))
+		}
+		if created != wantCreated {
+			t.Fatalf("unexpected created flag for message %d; want %v, got %v", msgs[0].Index, wantCreated, created)
+		}
+		return msgs[0]
+	}
+
+	first := appendNotification(notification("firing", "A", "B"), true)
+	// The order of alerts doesn't matter.
+	repeated := appendNotification(notification("firing", "B", "A"), false)
+	if repeated.Index != first.Index || repeated.Repeats != 1 || repeated.LastSeen == nil {
+		t.Fatalf("unexpected repeated message: %+v", repeated)
+	}
+	if msg, err := store.getMessage("alerts", first.Index); err != nil || msg.Repeats != 1 {
+		t.Fatalf("expected stored message to count the repeat, got %+v (err: %v)", msg, err)
+	}
+
+	appendNotification(notification("resolved", "A", "B"), true)
+	// Only the last notification of a group is collapsed into.
+	appendNotification(notification("firing", "A", "B"), true)
+	appendNotification(notification("firing", "A", "B"), false)
+
+	// Other payloads are never deduplicated.
+	appendNotification(map[string]interface{}{"foo": "bar"}, true)
+	appendNotification(map[string]interface{}{"foo": "bar"}, true)
+
+	// Once the window has passed, a repeated notification is stored again.
+	if _, err := store.gc(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	appendNotification(notification("firing", "A", "B"), true)
+}
+
+func TestBoltStoreAlertmanagerSplitAlerts(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, err := store.setTopicConfig("alerts", &TopicConfig{
+		Alertmanager: &AlertmanagerConfig{
+			DedupWindow: Duration(time.Hour),
+			SplitAlerts: true,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var notification interface{}
+	if err := json.Unmarshal([]byte(`{
+		"version": "4",
+		"groupKey": "{}:{alertname=\"HighLatency\"}",
+		"status": "firing",
+		"receiver": "cmdb",
+		"externalURL": "http://alertmanager:9093",
+		"commonLabels": {"alertname": "HighLatency"},
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "HighLatency", "instance": "a"}},
+			{"status": "firing", "labels": {"alertname": "HighLatency", "instance": "b"}}
+		]
+	}`), &notification); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, created, err := store.append("alerts", notification, appendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || len(msgs) != 2 || msgs[0].Index != 1 || msgs[1].Index != 2 {
+		t.Fatalf("expected two new messages, got %+v (created: %v)", msgs, created)
+	}
+
+	stored, err := store.get("alerts", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, instance := range []string{"a", "b"} {
+		alert := stored.Messages[i].Data.(map[string]interface{})
+		labels := alert["labels"].(map[string]interface{})
+		if labels["instance"] != instance {
+			t.Fatalf("unexpected instance of alert %d; want %q, got %v", i, instance, labels["instance"])
+		}
+		want := alertFingerprint(map[string]string{"alertname": "HighLatency", "instance": instance})
+		if alert["fingerprint"] != want {
+			t.Fatalf("unexpected fingerprint of alert %d; want %q, got %v", i, want, alert["fingerprint"])
+		}
+		if alert["receiver"] != "cmdb" || alert["externalURL"] != "http://alertmanager:9093" ||
+			alert["commonLabels"].(map[string]interface{})["alertname"] != "HighLatency" {
+			t.Fatalf("missing group-level fields in alert %d: %v", i, alert)
+		}
+	}
+
+	// Repeated notifications are collapsed into all messages of the group.
+	msgs, created, err = store.append("alerts", notification, appendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || len(msgs) != 2 || msgs[0].Repeats != 1 || msgs[1].Repeats != 1 {
+		t.Fatalf("expected two repeated messages, got %+v (created: %v)", msgs, created)
+	}
+}
+
+func TestBoltStoreAlertStates(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, err := store.setTopicConfig("alerts", &TopicConfig{
+		Alertmanager: &AlertmanagerConfig{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(status string, instances ...string) {
+		alerts := []interface{}{}
+		for _, instance := range instances {
+			alerts = append(alerts, map[string]interface{}{
+				"status": status,
+				"labels": map[string]interface{}{"alertname": "Down", "instance": instance},
+			})
+		}
+		if _, _, err := store.append("alerts", map[string]interface{}{
+			"groupKey": "{}:{}",
+			"status":   status,
+			"alerts":   alerts,
+		}, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(matchers []string, want ...string) {
+		if want == nil {
+			want = []string{}
+		}
+		ms, err := parseLabelMatchers(matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := store.getAlerts("alerts", ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, a := range resp.Alerts {
+			got = append(got, a.Labels["instance"])
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected firing alerts for %q; want %v, got %v", matchers, want, got)
+		}
+	}
+
+	notify("firing", "a", "b", "c")
+	notify("resolved", "b")
+	check(nil, "a", "c")
+	check([]string{`instance!="a"`}, "c")
+	check([]string{`alertname="Down"`, `instance=~"a|b"`}, "a")
+
+	// Rebuilding the states from the log must yield the same results.
+	if err := store.db.Update(rebuildAllAlerts); err != nil {
+		t.Fatal(err)
+	}
+	check(nil, "a", "c")
+
+	// Deleting or purging the latest report on an alert restores its state from
+	// the messages that remain.
+	notify("firing", "b")
+	check(nil, "a", "b", "c")
+	if err := store.deleteMessage("alerts", 3); err != nil {
+		t.Fatal(err)
+	}
+	check(nil, "a", "c")
+	if err := store.deleteMessage("alerts", 2); err != nil {
+		t.Fatal(err)
+	}
+	check(nil, "a", "b", "c")
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return purgeMessage(tx, []byte("alerts"), 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+	if err := store.db.Update(rebuildAllAlerts); err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+
+	if _, err := store.getAlerts("unknowntopic", nil); err != errTopicNotFound {
+		t.Fatalf("unexpected error getting alerts of missing topic: %v", err)
+	}
+	if _, _, err := store.append("plain", nil, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.getAlerts("plain", nil); err != errAlertsNotTracked {
+		t.Fatalf("unexpected error getting alerts of untracked topic: %v", err)
+	}
+}
+
+func TestBoltStoreAlertHistory(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, err := store.setTopicConfig("alerts", &TopicConfig{
+		Alertmanager: &AlertmanagerConfig{SplitAlerts: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	notify := func(status string, startsAt, endsAt time.Time, instances ...string) {
+		alerts := []interface{}{}
+		for _, instance := range instances {
+			alerts = append(alerts, map[string]interface{}{
+				"status":   status,
+				"labels":   map[string]interface{}{"alertname": "Down", "instance": instance},
+				"startsAt": startsAt,
+				"endsAt":   endsAt,
+			})
+		}
+		if _, _, err := store.append("alerts", map[string]interface{}{
+			"groupKey": "{}:{}",
+			"status":   status,
+			"alerts":   alerts,
+		}, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notify("firing", start, time.Time{}, "a", "b")
+	notify("firing", start, time.Time{}, "a")
+	notify("resolved", start, start.Add(5*time.Minute), "a")
+	notify("firing", start.Add(time.Hour), time.Time{}, "a")
+
+	fp := alertFingerprint(map[string]string{"alertname": "Down", "instance": "a"})
+	history, err := store.getAlertHistory("alerts", fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AlertTransition{
+		{Status: "firing", Timestamp: start, Index: 1},
+		{Status: "resolved", Timestamp: start.Add(5 * time.Minute), Index: 4, DurationSeconds: 300},
+		{Status: "firing", Timestamp: start.Add(time.Hour), Index: 5},
+	}
+	if !reflect.DeepEqual(history.Transitions, want) {
+		t.Fatalf("unexpected transitions\nwant: %+v\nhave: %+v", want, history.Transitions)
+	}
+	if history.Labels["instance"] != "a" {
+		t.Fatalf("unexpected labels: %v", history.Labels)
+	}
+
+	// Deleted messages drop out of the history.
+	if err := store.deleteMessage("alerts", 4); err != nil {
+		t.Fatal(err)
+	}
+	if history, err = store.getAlertHistory("alerts", fp); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Transitions) != 1 || history.Transitions[0].Index != 1 {
+		t.Fatalf("unexpected transitions after deletion: %+v", history.Transitions)
+	}
+
+	if _, err := store.getAlertHistory("alerts", "0000000000000000"); err != errAlertNotFound {
+		t.Fatalf("unexpected error getting history of unknown alert: %v", err)
+	}
+}
+
+func TestBoltStoreGetMatchers(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	var msgs []interface{}
+	if err := json.Unmarshal([]byte(`[
+		{"groupKey": "g", "alerts": [{"labels": {"alertname": "Watchdog", "severity": "none"}}]},
+		{"groupKey": "g", "alerts": [
+			{"labels": {"alertname": "Down", "severity": "warning"}},
+			{"labels": {"alertname": "Down", "severity": "page"}}
+		]},
+		{"host": {"name": "a", "tags": ["db", "eu"]}, "level": 3},
+		{"host": {"name": "b", "tags": ["web"]}, "level": 5},
+		{"fingerprint": "1234", "labels": {"alertname": "Full", "severity": "critical"}}
+	]`), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if _, _, err := store.append("testtopic", msg, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(q messageQuery, matchers []string, wantNext uint64, want ...uint64) {
+		var err error
+		if q.matchers, err = parseLabelMatchers(matchers); err != nil {
+			t.Fatal(err)
+		}
+		q.generationID = store.generationID
+		resp, err := store.get("testtopic", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []uint64{}
+		for _, msg := range resp.Messages {
+			got = append(got, msg.Index)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected messages for %q; want %v, got %v", matchers, want, got)
+		}
+		if resp.NextIndex != wantNext {
+			t.Fatalf("unexpected next index for %q; want %d, got %d", matchers, wantNext, resp.NextIndex)
+		}
+	}
+
+	check(messageQuery{}, []string{`severity=~"critical|page"`}, 6, 2, 5)
+	check(messageQuery{}, []string{`alertname!="Watchdog"`, `severity="warning"`}, 6, 2)
+	check(messageQuery{}, []string{`host.name="b"`}, 6, 4)
+	check(messageQuery{}, []string{`host.tags[1]="eu"`}, 6, 3)
+	check(messageQuery{}, []string{`level=~"[0-4]"`}, 6, 3)
+	check(messageQuery{}, []string{`alerts[0].labels.alertname="Watchdog"`}, 6, 1)
+	check(messageQuery{limit: 1}, []string{`severity=~".+"`}, 2, 1)
+	check(messageQuery{since: time.Now().Add(-time.Hour)}, []string{`host.name=~".+"`}, 6, 3, 4)
+
+	if _, err := parseLabelMatchers([]string{`foo~"bar"`}); err == nil {
+		t.Fatal("expected error parsing invalid matcher")
+	}
+	if _, err := parseLabelMatchers([]string{`foo[x]="bar"`}); err == nil {
+		t.Fatal("expected error parsing matcher with invalid JSON path")
+	}
+}
+
+func TestBoltStoreGetFields(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{
+		"status": "firing",
+		"receiver": "mobile",
+		"alerts": [
+			{"labels": {"alertname": "Down", "severity": "page"}, "annotations": {"summary": "Host down"}, "generatorURL": "http://prometheus"},
+			{"labels": {"alertname": "Full"}, "generatorURL": "http://prometheus"}
+		]
+	}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.append("testtopic", data, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []jsonPath
+	for _, f := range []string{"status", "alerts.labels.severity", "alerts.annotations", "alerts[1].labels.alertname", "missing"} {
+		p, err := parseJSONPath(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields = append(fields, p)
+	}
+	resp, err := store.get("testtopic", messageQuery{fields: fields})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want interface{}
+	if err := json.Unmarshal([]byte(`{
+		"status": "firing",
+		"alerts": [
+			{"labels": {"severity": "page"}, "annotations": {"summary": "Host down"}},
+			{"labels": {"alertname": "Full"}}
+		]
+	}`), &want); err != nil {
+		t.Fatal(err)
+	}
+	msg := resp.Messages[0]
+	if !reflect.DeepEqual(msg.Data, want) {
+		t.Fatalf("unexpected projected data\nwant: %v\nhave: %v", want, msg.Data)
+	}
+	if msg.Index != 1 || msg.Timestamp.IsZero() {
+		t.Fatalf("expected index and timestamp to be kept, got %+v", msg)
+	}
+}
+
+func TestBoltStoreMessageMeta(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	metaOpts := &metaOptions{headers: []string{"user-agent", "X-Request-ID"}}
+	req := httptest.NewRequest("POST", "/topics/testtopic", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("User-Agent", "Alertmanager/0.15.0")
+	req.Header.Set("Cookie", "session=1")
+	data := map[string]interface{}{"groupKey": "{}:{}", "receiver": "mobile"}
+
+	// Basic auth isn't verified, so its user name is no principal.
+	meta := metaOpts.capture(req, data)
+	want := &MessageMeta{
+		RemoteAddr: "10.0.0.1:1234",
+		Headers:    map[string]string{"User-Agent": "Alertmanager/0.15.0"},
+		Receiver:   "mobile",
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Fatalf("unexpected metadata\nwant: %+v\nhave: %+v", want, meta)
+	}
+
+	// The principal is taken from the configured header of a trusted proxy.
+	req.Header.Set("X-Forwarded-User", "bob")
+	metaOpts.principalHeader = "X-Forwarded-User"
+	if p := metaOpts.capture(req, data).Principal; p != "bob" {
+		t.Fatalf("unexpected principal; want %q, got %q", "bob", p)
+	}
+
+	if _, _, err := store.append("testtopic", data, appendOptions{meta: meta}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.appendBatch("testtopic", []interface{}{1}, appendOptions{meta: meta}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata is hidden unless the store exposes it.
+	resp, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range resp.Messages {
+		if msg.Meta != nil {
+			t.Fatalf("expected metadata to be hidden, got %+v", msg.Meta)
+		}
+	}
+	msg, err := store.getMessage("testtopic", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Meta != nil {
+		t.Fatalf("expected metadata to be hidden, got %+v", msg.Meta)
+	}
+
+	store.options.exposeMeta = true
+	resp, err = store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range resp.Messages {
+		if !reflect.DeepEqual(msg.Meta, want) {
+			t.Fatalf("unexpected metadata of message %d\nwant: %+v\nhave: %+v", msg.Index, want, msg.Meta)
+		}
+	}
+	msg, err = store.getMessage("testtopic", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Meta, want) {
+		t.Fatalf("unexpected metadata\nwant: %+v\nhave: %+v", want, msg.Meta)
+	}
+}
+
+func TestBoltStoreEventTime(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, err := store.setTopicConfig("testtopic", &TopicConfig{
+		Retention:     RetentionPolicy{MaxAge: Duration(time.Hour), TimeBasis: timeBasisEvent},
+		EventTimePath: "alerts[0].startsAt",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	backfilled := now.Add(-3 * time.Hour)
+	if _, _, err := store.append("testtopic", map[string]interface{}{"name": "a"}, appendOptions{eventTime: &backfilled}); err != nil {
+		t.Fatal(err)
+	}
+	startsAt := now.Add(-30 * time.Minute).Truncate(time.Second)
+	data := map[string]interface{}{
+		"name":   "b",
+		"alerts": []interface{}{map[string]interface{}{"startsAt": startsAt.Format(time.RFC3339)}},
+	}
+	if _, _, err := store.append("testtopic", data, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.append("testtopic", map[string]interface{}{"name": "c"}, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := store.getMessage("testtopic", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.EventTime == nil || !msg.EventTime.Equal(startsAt) {
+		t.Fatalf("unexpected event time; want %v, got %v", startsAt, msg.EventTime)
+	}
+
+	// Times that can't be indexed are ignored.
+	cfg, err := store.topicConfig("testtopic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []interface{}{"1969-12-31T23:59:59Z", -100.0, "2262-04-12T00:00:00Z"} {
+		data := map[string]interface{}{"alerts": []interface{}{map[string]interface{}{"startsAt": ts}}}
+		if et := cfg.eventTime(data); et != nil {
+			t.Fatalf("expected event time %v to be ignored, got %v", ts, et)
+		}
+	}
+
+	names := func(q messageQuery) []string {
+		resp, err := store.get("testtopic", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, msg := range resp.Messages {
+			names = append(names, msg.Data.(map[string]interface{})["name"].(string))
+		}
+		return names
+	}
+	// Messages without an event time are found by their timestamp.
+	if got, want := names(messageQuery{since: now.Add(-time.Hour), eventTime: true}), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages since an hour ago; want %v, got %v", want, got)
+	}
+	if got, want := names(messageQuery{until: now.Add(-2 * time.Hour), eventTime: true}), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages until two hours ago; want %v, got %v", want, got)
+	}
+	if got := names(messageQuery{until: now.Add(-2 * time.Hour)}); got != nil {
+		t.Fatalf("expected no messages stored until two hours ago, got %v", got)
+	}
+
+	// The backfilled message is beyond retention by its event time.
+	if _, err := store.gc(now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(messageQuery{}), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages after GC; want %v, got %v", want, got)
+	}
+
+	// Split alerts each get the event time at the path within them.
+	if _, err := store.setTopicConfig("splittopic", &TopicConfig{
+		Alertmanager:  &AlertmanagerConfig{SplitAlerts: true},
+		EventTimePath: "startsAt",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	startsAts := []time.Time{now.Add(-2 * time.Hour).Truncate(time.Second), now.Add(-time.Hour).Truncate(time.Second)}
+	notification := map[string]interface{}{
+		"groupKey": "{}:{}",
+		"alerts": []interface{}{
+			map[string]interface{}{"labels": map[string]interface{}{"instance": "a"}, "startsAt": startsAts[0].Format(time.RFC3339)},
+			map[string]interface{}{"labels": map[string]interface{}{"instance": "b"}, "startsAt": startsAts[1].Format(time.RFC3339)},
+		},
+	}
+	msgs, _, err := store.append("splittopic", notification, appendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range msgs {
+		if msg.EventTime == nil || !msg.EventTime.Equal(startsAts[i]) {
+			t.Fatalf("unexpected event time of alert %d; want %v, got %v", i, startsAts[i], msg.EventTime)
+		}
+	}
+}
+
+func TestBoltStoreMessageTTL(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	if _, _, err := store.append("testtopic", "heartbeat", appendOptions{ttl: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.append("testtopic", "event", appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.appendBatch("testtopic", []interface{}{"a", "b"}, appendOptions{ttl: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 4 {
+		t.Fatalf("unexpected number of messages before expiry; want 4, got %d", len(msgs.Messages))
+	}
+	msg := msgs.Messages[0]
+	if msg.ExpiresAt == nil || !msg.ExpiresAt.Equal(msg.Timestamp.Add(50*time.Millisecond)) {
+		t.Fatalf("unexpected expiry time %v for timestamp %v", msg.ExpiresAt, msg.Timestamp)
+	}
+
+	// Expired messages are hidden right away.
+	time.Sleep(100 * time.Millisecond)
+	msgs, err = store.get("testtopic", messageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs.Messages) != 3 || msgs.Messages[0].Index != 2 {
+		t.Fatalf("expected expired message to be hidden, got %+v", msgs.Messages)
+	}
+	if _, err := store.getMessage("testtopic", 1); err != errMessageNotFound {
+		t.Fatalf("expected expired message not to be found, got %v", err)
+	}
+
+	// GC purges expired messages, even within the retention time.
+	numDeleted, err := store.gc(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numDeleted != 1 {
+		t.Fatalf("unexpected number of purged messages; want 1, got %d", numDeleted)
+	}
+	store.db.View(func(tx *bolt.Tx) error {
+		if stats := getTopicStats(tx, []byte("testtopic")); stats.count != 3 {
+			t.Fatalf("unexpected number of messages after GC; want 3, got %d", stats.count)
+		}
+		return nil
+	})
+}
+
+func TestBoltStoreQuota(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	quota := &QuotaPolicy{MaxMessages: 3}
+	if _, err := store.setTopicConfig("testtopic", &TopicConfig{Quota: quota}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, _, err := store.append("testtopic", i, appendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.append("testtopic", 4, appendOptions{}); err != errQuotaExceeded {
+		t.Fatalf("expected append over quota to be rejected, got %v", err)
+	}
+	if _, err := store.appendBatch("testtopic", []interface{}{4}, appendOptions{}); err != errQuotaExceeded {
+		t.Fatalf("expected batch append over quota to be rejected, got %v", err)
+	}
+
+	indexes := func() []uint64 {
+		msgs, err := store.get("testtopic", messageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idxs []uint64
+		for _, msg := range msgs.Messages {
+			idxs = append(idxs, msg.Index)
+		}
+		return idxs
+	}
+	if got, want := indexes(), []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages after rejected appends; want %v, got %v", want, got)
+	}
+
+	// Dropping the oldest messages makes room for new ones.
+	quota.Action = quotaDropOldest
+	if _, err := store.setTopicConfig("testtopic", &TopicConfig{Quota: quota}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.appendBatch("testtopic", []interface{}{4, 5}, appendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexes(), []uint64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages after dropping the oldest; want %v, got %v", want, got)
+	}
+
+	// Appends that exceed the quota on their own are still rejected.
+	if _, err := store.appendBatch("testtopic", []interface{}{6, 7, 8, 9}, appendOptions{}); err != errQuotaExceeded {
+		t.Fatalf("expected oversized batch append to be rejected, got %v", err)
+	}
+	if got, want := indexes(), []uint64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected messages after rejected append; want %v, got %v", want, got)
+	}
+}
+
+func TestBoltStoreGetTimeRangePaging(t *testing.T) {
+	store, close := newTestBoltStore(t)
+	defer close()
+
+	pages := func(topic string, q messageQuery) [][]uint64 {
+		var pages [][]uint64
+		for {
+			msgs, err := store.get(topic, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page []uint64
+			for _, msg := range msgs.Messages {
+				page = append(page, msg.Index)
+			}
+			pages = append(pages, page)
+			if !msgs.HasMore {
+				return pages
+			}
+			q.generationID, q.fromIndex = msgs.GenerationID, msgs.NextIndex
+		}
+	}
+
+	// Timestamps slightly out of index order are still returned in index
+	// order, without gaps between pages.
+	base := time.Now().Add(-time.Minute)
+	for _, offset := range []time.Duration{0, 2, 1, 3, 5, 4, 6} {
+		appendWithTimestamp(t, store, "testtopic", base.Add(offset*time.Second))
+	}
+	got := pages("testtopic", messageQuery{since: base, limit: 2})
+	if want := [][]uint64{{1, 2}, {3, 4}, {5, 6}, {7}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected pages; want %v, got %v", want, got)
+	}
+
+	// A future-dated message within the range doesn't hide the ones after it.
+	until := base.Add(time.Minute)
+	for _, ts := range []time.Time{base.Add(time.Second), base.Add(2 * time.Second), until.Add(time.Hour), base.Add(3 * time.Second), base.Add(4 * time.Second)} {
+		appendWithTimestamp(t, store, "outliertopic", ts)
+	}
+	got = pages("outliertopic", messageQuery{since: base, until: until, limit: 2})
+	if want := [][]uint64{{1, 2}, {4, 5}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected pages; want %v, got %v", want, got)
+	}
+}
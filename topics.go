@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Content modes determine which payloads a topic accepts.
+const (
+	// contentObject accepts JSON objects only. It is the default.
+	contentObject = "object"
+	// contentJSON accepts any JSON value.
+	contentJSON = "json"
+	// contentRaw accepts arbitrary bytes, which are stored base64-encoded
+	// along with their content type.
+	contentRaw = "raw"
+)
+
+// Quota actions determine what happens when an append exceeds a topic's quota.
+const (
+	// quotaReject rejects the append. It is the default.
+	quotaReject = "reject"
+	// quotaDropOldest purges the oldest messages of the topic to make room.
+	quotaDropOldest = "dropOldest"
+)
+
+// Time bases determine which time of a message retention applies to.
+const (
+	// timeBasisIngestion applies retention to the time at which a message was
+	// stored. It is the default.
+	timeBasisIngestion = "ingestion"
+	// timeBasisEvent applies retention to the event time of a message, if it
+	// has one.
+	timeBasisEvent = "event"
+)
+
+// A TopicConfig holds the settings of a single topic.
+type TopicConfig struct {
+	Retention    RetentionPolicy     `json:"retention"`
+	Alertmanager *AlertmanagerConfig `json:"alertmanager,omitempty"`
+	Content      string              `json:"content,omitempty"`
+	// EventTimePath is the JSON path of the event time within the data of
+	// appended messages, e.g. alerts[0].startsAt.
+	EventTimePath string `json:"eventTimePath,omitempty"`
+	// MaxMessageBytes overrides the server's limit on the size of appended
+	// request bodies.
+	MaxMessageBytes uint64       `json:"maxMessageBytes,omitempty"`
+	Quota           *QuotaPolicy `json:"quota,omitempty"`
+}
+
+// A QuotaPolicy limits the number and total size of the messages that a topic
+// holds. Unlike retention limits, which are enforced by GC, quotas are
+// enforced on every append, according to the action. Zero values mean that
+// there is no limit.
+type QuotaPolicy struct {
+	MaxMessages uint64 `json:"maxMessages,omitempty"`
+	MaxBytes    uint64 `json:"maxBytes,omitempty"`
+	Action      string `json:"action,omitempty"`
+}
+
+// allows returns whether a topic with the given statistics is within the
+// quota.
+func (q *QuotaPolicy) allows(stats topicStats) bool {
+	return (q.MaxMessages == 0 || stats.count <= q.MaxMessages) &&
+		(q.MaxBytes == 0 || stats.bytes <= q.MaxBytes)
+}
+
+// validate checks the configuration for invalid settings.
+func (cfg *TopicConfig) validate() error {
+	switch cfg.Content {
+	case "", contentObject, contentJSON, contentRaw:
+	default:
+		return fmt.Errorf("invalid content mode %q", cfg.Content)
+	}
+	switch cfg.Retention.TimeBasis {
+	case "", timeBasisIngestion, timeBasisEvent:
+	default:
+		return fmt.Errorf("invalid retention time basis %q", cfg.Retention.TimeBasis)
+	}
+	if cfg.Quota != nil {
+		switch cfg.Quota.Action {
+		case "", quotaReject, quotaDropOldest:
+		default:
+			return fmt.Errorf("invalid quota action %q", cfg.Quota.Action)
+		}
+	}
+	if cfg.EventTimePath != "" {
+		if _, err := parseJSONPath(cfg.EventTimePath); err != nil {
+			return fmt.Errorf("invalid event time path: %v", err)
+		}
+	}
+	return nil
+}
+
+// eventTime returns the time at the event time path within decoded message
+// data, given as an RFC3339 string or as a Unix timestamp in seconds. It
+// returns nil if the topic has no event time path or there is no valid time at
+// it, including times that are out of the indexable range.
+func (cfg *TopicConfig) eventTime(data interface{}) *time.Time {
+	if cfg.EventTimePath == "" {
+		return nil
+	}
+	path, err := parseJSONPath(cfg.EventTimePath)
+	if err != nil {
+		return nil
+	}
+	if a, ok := data.(splitAlert); ok {
+		// Split alerts are looked up in the form they are stored in.
+		buf, err := json.Marshal(a)
+		if err != nil {
+			return nil
+		}
+		if err := json.Unmarshal(buf, &data); err != nil {
+			return nil
+		}
+	}
+	v, _ := path.lookup(data)
+	var t time.Time
+	switch v := v.(type) {
+	case string:
+		if t, err = parseTime(v); err != nil {
+			return nil
+		}
+	case float64:
+		t = time.Unix(0, int64(v*float64(time.Second)))
+	}
+	if t.IsZero() || !validEventTime(t) {
+		return nil
+	}
+	return &t
+}
+
+// A RetentionPolicy limits which messages of a topic are kept. Messages are
+// purged once they exceed any of the limits, oldest first. Zero values mean that
+// the store-wide default applies, or that there is no limit if there is no such
+// default. TimeBasis selects whether MaxAge applies to the ingestion or the
+// event time of messages.
+type RetentionPolicy struct {
+	MaxAge      Duration `json:"maxAge,omitempty"`
+	TimeBasis   string   `json:"timeBasis,omitempty"`
+	MaxMessages uint64   `json:"maxMessages,omitempty"`
+	MaxBytes    uint64   `json:"maxBytes,omitempty"`
+}
+
+// A TopicInfo describes a topic and the messages it currently holds.
+type TopicInfo struct {
+	Name            string      `json:"name"`
+	Messages        uint64      `json:"messages"`
+	FirstIndex      uint64      `json:"firstIndex"`
+	LastIndex       uint64      `json:"lastIndex"`
+	OldestTimestamp *time.Time  `json:"oldestTimestamp,omitempty"`
+	NewestTimestamp *time.Time  `json:"newestTimestamp,omitempty"`
+	Bytes           uint64      `json:"bytes"`
+	Config          TopicConfig `json:"config"`
+}
+
+// A TopicsResponse lists the existing topics for a given generation ID.
+type TopicsResponse struct {
+	GenerationID string      `json:"generationID"`
+	Topics       []TopicInfo `json:"topics"`
+}
+
+// A Duration is a time.Duration that is represented as a Prometheus-style
+// duration string (e.g. "7d") in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(model.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := model.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
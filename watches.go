@@ -1,16 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
+// defaultWatchBatchSize is the maximum number of messages pushed to a watching
+// client at once unless the client requests a different limit.
+const defaultWatchBatchSize = 1000
+
 type watchManager struct {
 	upgrader     *websocket.Upgrader
 	store        messageStore
@@ -33,6 +40,12 @@ func (wm *watchManager) handleWatchRequest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	q, err := parseMessageQuery(r.URL.Query(), defaultWatchBatchSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := wm.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade HTTP connection: %v", err)
@@ -40,41 +53,259 @@ func (wm *watchManager) handleWatchRequest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	genID := r.URL.Query().Get("generationID")
-	fromIdx := r.URL.Query().Get("fromIndex")
+	go wm.manageWatch(conn, topic, q)
+}
+
+func (wm *watchManager) handleEventsRequest(w http.ResponseWriter, r *http.Request) {
+	topic, ok := mux.Vars(r)["topic"]
+	if !ok {
+		log.Printf("Error: topic not provided")
+		http.Error(w, "must provide topic", http.StatusBadRequest)
+		return
+	}
 
-	if fromIdx == "" {
-		fromIdx = "0"
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
 	}
 
-	idx, err := strconv.ParseUint(fromIdx, 10, 64)
+	q, err := parseMessageQuery(r.URL.Query(), defaultWatchBatchSize)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid 'fromIndex': %v", err), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	go wm.manageWatch(conn, topic, genID, idx)
+	// A reconnecting EventSource tells us the generation ID and index of the
+	// last message it has seen, which take precedence over the originally
+	// requested ones.
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		genID, lastIdx, err := parseEventID(lastID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid 'Last-Event-ID': %v", err), http.StatusBadRequest)
+			return
+		}
+		q.generationID = genID
+		q.fromIndex = lastIdx + 1
+	}
+
+	// An EventSource reconnects whenever the stream ends, until it receives a
+	// 204 response. Tell it to stop once the time range has ended and all of
+	// its messages have been sent.
+	if q.rangeEnded(time.Now()) {
+		msgs, err := wm.store.get(topic, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(msgs.Messages) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.Printf("Event stream accepted from %v", r.RemoteAddr)
+	err = wm.follow(topic, q, r.Context().Done(), func(msgs *MessagesResponse) error {
+		data, err := json.Marshal(msgs)
+		if err != nil {
+			return err
+		}
+		lastIdx := msgs.Messages[len(msgs.Messages)-1].Index
+		if _, err := fmt.Fprintf(w, "id: %s:%d\ndata: %s\n\n", msgs.GenerationID, lastIdx, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func(tombstones *MessagesResponse) error {
+		// Tombstones of messages that were already sent don't move the
+		// stream's position, so they are sent as events without an ID.
+		data, err := json.Marshal(tombstones)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: deleted\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Closing event stream to %v due to error: %v", r.RemoteAddr, err)
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		return
+	}
+	if r.Context().Err() == nil {
+		// The time range has ended. Clients that don't close the stream on
+		// this event get a 204 response when they reconnect.
+		fmt.Fprint(w, "event: end\ndata: {}\n\n")
+	}
+	log.Printf("Terminating event stream to %v", r.RemoteAddr)
 }
 
-func (wm *watchManager) manageWatch(conn *websocket.Conn, topic, genID string, idx uint64) {
+// parseEventID parses the ID of a server-sent event, which consists of the
+// generation ID and the index of the last message in the event.
+func parseEventID(id string) (string, uint64, error) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("missing generation ID in %q", id)
+	}
+	idx, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return id[:i], idx, nil
+}
+
+func (wm *watchManager) manageWatch(conn *websocket.Conn, topic string, q messageQuery) {
 	log.Printf("Connection accepted from %v", conn.RemoteAddr())
 	defer closeConn(conn)
+
+	// We don't expect any data messages from the client, but we need to keep
+	// reading from the connection to process control messages and to notice
+	// when the client goes away while we are waiting for new messages.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msgs *MessagesResponse) error {
+		return conn.WriteJSON(msgs)
+	}
+	err := wm.follow(topic, q, gone, send, send)
+	if err != nil {
+		handleError(err, conn)
+	}
+}
+
+// follow calls send with every new batch of messages appended to the topic that
+// match the query, until either send fails, done is closed, or no more messages
+// can match the query's time range. If sendDeleted is not nil, it is called
+// with the tombstones of matching messages that are deleted after they have
+// been sent. Their response's NextIndex is the position of the batches sent so
+// far.
+func (wm *watchManager) follow(topic string, q messageQuery, done <-chan struct{}, send, sendDeleted func(*MessagesResponse) error) error {
+	var deleted <-chan struct{}
+	var deletions *deletionWatch
+	if sendDeleted != nil {
+		var stop func()
+		deletions, stop = wm.store.watchDeletions(topic)
+		defer stop()
+		deleted = deletions.ready
+	}
+
+	stopWaiting := func() {}
+	defer func() { stopWaiting() }()
 	for {
-		msgsResponse, err := wm.store.get(topic, genID, idx)
+		// Obtain the notification channel before reading from the store so that
+		// appends happening in between are not missed.
+		stopWaiting()
+		var appended <-chan struct{}
+		appended, stopWaiting = wm.store.wait(topic)
+
+		msgsResponse, err := wm.store.get(topic, q)
 		if err != nil {
-			handleError(err, conn)
-			return
+			return err
 		}
-		if msgsLength := len(msgsResponse.Messages); msgsLength > 0 {
-			if err := conn.WriteJSON(msgsResponse); err != nil {
-				handleError(err, conn)
-				return
+		if len(msgsResponse.Messages) > 0 {
+			if err := send(msgsResponse); err != nil {
+				return err
 			}
-			idx = msgsResponse.Messages[msgsLength-1].Index + 1
-			genID = msgsResponse.GenerationID
 		}
-		time.Sleep(wm.pushInterval)
+		// Advance past non-matching messages as well, so that they are not read
+		// again after the next append.
+		q.fromIndex = msgsResponse.NextIndex
+		q.generationID = msgsResponse.GenerationID
+		if msgsResponse.HasMore {
+			// Keep sending the backlog without waiting for new appends.
+			select {
+			case <-done:
+				return nil
+			default:
+				continue
+			}
+		}
+		if q.rangeEnded(time.Now()) {
+			return nil
+		}
+
+		select {
+		case <-appended:
+		case <-deleted:
+			tombstones := &MessagesResponse{
+				GenerationID: q.generationID,
+				Messages:     []Message{},
+				NextIndex:    q.fromIndex,
+			}
+			for _, n := range deletions.take() {
+				// Later messages are read as tombstones in sequence.
+				if n.Index < q.fromIndex && q.matchesTime(n) && matchData(q.matchers, n.Data) {
+					tombstones.Messages = append(tombstones.Messages, n.tombstone())
+				}
+			}
+			if len(tombstones.Messages) > 0 {
+				if err := sendDeleted(tombstones); err != nil {
+					return err
+				}
+			}
+			continue
+		case <-done:
+			return nil
+		}
+
+		// Give further messages a chance to arrive so that they can be pushed
+		// to the client in a single batch.
+		if wm.pushInterval > 0 {
+			select {
+			case <-time.After(wm.pushInterval):
+			case <-done:
+				return nil
+			}
+		}
+	}
+}
+
+// errStopFollowing is returned by send functions to stop following a topic.
+var errStopFollowing = errors.New("stop following")
+
+// waitForMessages waits up to the given duration for messages that match the
+// query to be appended to the topic, and returns the first batch of them. It
+// returns nil if there are none by then, or if done is closed before.
+func (wm *watchManager) waitForMessages(topic string, q messageQuery, wait time.Duration, done <-chan struct{}) (*MessagesResponse, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	expired := make(chan struct{})
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-timer.C:
+		case <-done:
+		case <-returned:
+			return
+		}
+		close(expired)
+	}()
+
+	var msgs *MessagesResponse
+	err := wm.follow(topic, q, expired, func(m *MessagesResponse) error {
+		msgs = m
+		return errStopFollowing
+	}, nil)
+	if err != nil && err != errStopFollowing {
+		return nil, err
 	}
+	return msgs, nil
 }
 
 func closeConn(conn *websocket.Conn) {
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,27 +20,79 @@ import (
 var subject = "watchManager"
 
 type testMessageStore struct {
+	// Embedding the interface satisfies methods that watches don't use. Calling
+	// them panics.
+	messageStore
+
+	mtx      sync.Mutex
 	messages []Message
+	notifier *topicNotifier
+	// queries records the queries of all calls to get.
+	queries []messageQuery
+}
+
+// testGenerationID is the generation ID of all test message stores.
+const testGenerationID = "test-generation"
+
+func newTestMessageStore() *testMessageStore {
+	return &testMessageStore{
+		notifier: newTopicNotifier(),
+	}
 }
 
-func (s *testMessageStore) append(topic string, v interface{}) error {
-	s.messages = append(s.messages, Message{
+func (s *testMessageStore) append(topic string, v interface{}, opts appendOptions) ([]Message, bool, error) {
+	s.mtx.Lock()
+	msg := Message{
 		Index:     uint64(len(s.messages) + 1),
 		Timestamp: time.Now(),
 		Data:      v,
-	})
-	return nil
+	}
+	s.messages = append(s.messages, msg)
+	s.mtx.Unlock()
+	s.notifier.notify(topic)
+	return []Message{msg}, true, nil
 }
 
-func (s *testMessageStore) get(topic string, generationID string, fromIndex uint64) (*MessagesResponse, error) {
-	i := int(fromIndex) - 1
-	if i < 0 {
-		i = 0
+func (s *testMessageStore) get(topic string, q messageQuery) (*MessagesResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.queries = append(s.queries, q)
+	// Like the real store, return all messages if the generation doesn't
+	// match.
+	if q.generationID != testGenerationID {
+		q.fromIndex = 0
+	}
+	resp := &MessagesResponse{
+		GenerationID: testGenerationID,
+		Messages:     []Message{},
+		NextIndex:    q.fromIndex,
+	}
+	for _, msg := range s.messages {
+		if msg.Index < q.fromIndex || !q.matchesTime(msg) {
+			continue
+		}
+		if !matchData(q.matchers, msg.Data) {
+			// Like the real store, skip non-matching messages for good.
+			resp.NextIndex = msg.Index + 1
+			continue
+		}
+		if q.limit > 0 && len(resp.Messages) == q.limit {
+			resp.HasMore = true
+			break
+		}
+		resp.Messages = append(resp.Messages, msg)
+		resp.NextIndex = msg.Index + 1
 	}
-	return &MessagesResponse{
-		GenerationID: generationID,
-		Messages:     s.messages[i:],
-	}, nil
+	return resp, nil
+}
+
+func (s *testMessageStore) wait(topic string) (<-chan struct{}, func()) {
+	return s.notifier.wait(topic)
+}
+
+func (s *testMessageStore) watchDeletions(topic string) (*deletionWatch, func()) {
+	return s.notifier.watchDeletions(topic)
 }
 
 func TestWatch(t *testing.T) {
@@ -52,6 +110,13 @@ func TestWatch(t *testing.T) {
 			messageDelay: time.Millisecond,
 			pushInterval: time.Millisecond * 2,
 		},
+		{
+			context:      "No push interval is configured",
+			expectation:  "send messages to client as soon as they are appended",
+			messageCount: 10,
+			messageDelay: time.Millisecond * 20,
+			pushInterval: 0,
+		},
 	}
 
 	for _, test := range tests {
@@ -68,7 +133,7 @@ func runWatchTest(t *testing.T, test struct {
 }) {
 	t.Logf("When %s, %s should %s", test.context, subject, test.expectation)
 
-	store := &testMessageStore{}
+	store := newTestMessageStore()
 	dialer := websocket.DefaultDialer
 	r := mux.NewRouter()
 	watchManager := newWatchManager(store, test.pushInterval)
@@ -96,12 +161,13 @@ func runWatchTest(t *testing.T, test struct {
 		}
 	}()
 
-	submittedMessages := []string{}
+	submittedMessages := make([]string, 0, test.messageCount)
+	for i := 0; i < test.messageCount; i++ {
+		submittedMessages = append(submittedMessages, fmt.Sprintf("{test packet #%v}", i))
+	}
 	go func() {
-		for i := 0; i < test.messageCount; i++ {
-			item := fmt.Sprintf("{test packet #%v}", i)
-			store.append("testtopic", item)
-			submittedMessages = append(submittedMessages, item)
+		for _, item := range submittedMessages {
+			store.append("mytopic", item, appendOptions{})
 			time.Sleep(test.messageDelay)
 		}
 	}()
@@ -127,3 +193,193 @@ func runWatchTest(t *testing.T, test struct {
 	}
 
 }
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	store := newTestMessageStore()
+	for i := 1; i <= 5; i++ {
+		store.append("mytopic", fmt.Sprintf("{test packet #%v}", i), appendOptions{})
+	}
+
+	r := mux.NewRouter()
+	watchManager := newWatchManager(store, 0)
+	r.HandleFunc("/topics/{topic}/events", watchManager.handleEventsRequest)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resume := func(lastID string) (string, *MessagesResponse) {
+		req, err := http.NewRequest("GET", server.URL+"/topics/mytopic/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Last-Event-ID", lastID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type; want %q, got %q", "text/event-stream", ct)
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		var id string
+		var msgs MessagesResponse
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimPrefix(line, "id: ")
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msgs); err != nil {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+		return id, &msgs
+	}
+
+	id, msgs := resume(testGenerationID + ":3")
+	if want := testGenerationID + ":5"; id != want {
+		t.Fatalf("unexpected event ID; want %q, got %q", want, id)
+	}
+	if len(msgs.Messages) != 2 || msgs.Messages[0].Index != 4 {
+		t.Fatalf("expected messages 4 and 5, got %v", msgs.Messages)
+	}
+
+	// Indexes of another generation are not valid anymore.
+	if _, msgs = resume("old-generation:3"); len(msgs.Messages) != 5 {
+		t.Fatalf("expected all messages after a generation change, got %v", msgs.Messages)
+	}
+}
+
+func TestEventsEndWithTimeRange(t *testing.T) {
+	store := newTestMessageStore()
+	for i := 1; i <= 2; i++ {
+		store.append("mytopic", fmt.Sprintf("{test packet #%v}", i), appendOptions{})
+	}
+	until := time.Now()
+
+	r := mux.NewRouter()
+	watchManager := newWatchManager(store, 0)
+	r.HandleFunc("/topics/{topic}/events", watchManager.handleEventsRequest)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	request := func(lastID string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+"/topics/mytopic/events?until="+until.Format(time.RFC3339Nano), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		return resp
+	}
+
+	// The stream ends with an end event after the messages in the time range.
+	resp := request("")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status; want %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if want := "id: " + testGenerationID + ":2\n"; !strings.Contains(string(body), want) {
+		t.Fatalf("expected event with ID of message 2, got %q", body)
+	}
+	if !strings.HasSuffix(string(body), "event: end\ndata: {}\n\n") {
+		t.Fatalf("expected stream to end with an end event, got %q", body)
+	}
+
+	// Reconnecting clients are told to stop.
+	resp = request(testGenerationID + ":2")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status of reconnect; want %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestWatchChunksBacklog(t *testing.T) {
+	store := newTestMessageStore()
+	for i := 1; i <= 10; i++ {
+		store.append("mytopic", fmt.Sprintf("{test packet #%v}", i), appendOptions{})
+	}
+
+	r := mux.NewRouter()
+	watchManager := newWatchManager(store, 0)
+	r.HandleFunc("/topics/{topic}/watch", watchManager.handleWatchRequest)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	u.Scheme = "ws"
+	u.Path = "/topics/mytopic/watch"
+	u.RawQuery = "limit=4"
+
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v\nresponse: %#v", err, resp)
+	}
+	defer conn.Close()
+
+	wantSizes := []int{4, 4, 2}
+	for i, want := range wantSizes {
+		var msgs MessagesResponse
+		if err := conn.ReadJSON(&msgs); err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs.Messages) != want {
+			t.Fatalf("unexpected size of frame %d; want %d, got %d", i, want, len(msgs.Messages))
+		}
+		if hasMore := i < len(wantSizes)-1; msgs.HasMore != hasMore {
+			t.Fatalf("unexpected hasMore of frame %d; want %v, got %v", i, hasMore, msgs.HasMore)
+		}
+	}
+}
+
+func TestFollowSkipsNonMatchingMessages(t *testing.T) {
+	store := newTestMessageStore()
+	for i := 1; i <= 3; i++ {
+		store.append("mytopic", map[string]interface{}{"kind": "other"}, appendOptions{})
+	}
+	matchers, err := parseLabelMatchers([]string{`kind="wanted"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchManager := newWatchManager(store, 0)
+	done := make(chan struct{})
+	defer close(done)
+	go watchManager.follow("mytopic", messageQuery{matchers: matchers}, done, func(*MessagesResponse) error {
+		return nil
+	}, nil)
+
+	waitQueries := func(n int) messageQuery {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			store.mtx.Lock()
+			queries := store.queries
+			store.mtx.Unlock()
+			if len(queries) >= n {
+				return queries[n-1]
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for query %d", n)
+		return messageQuery{}
+	}
+
+	waitQueries(1)
+	store.append("mytopic", map[string]interface{}{"kind": "other"}, appendOptions{})
+	// Messages that didn't match the first time are not read again.
+	if q := waitQueries(2); q.fromIndex != 4 || q.generationID != testGenerationID {
+		t.Fatalf("expected follow to continue at index 4 of generation %q, got index %d of generation %q", testGenerationID, q.fromIndex, q.generationID)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,54 +19,591 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func serve(addr string, pushInterval time.Duration, store messageStore, registry *prometheus.Registry) error {
+// parseMessageQuery parses the query parameters that select which messages of a
+// topic to retrieve. The limit defaults to defaultLimit if it is not set.
+func parseMessageQuery(query url.Values, defaultLimit int) (messageQuery, error) {
+	q := messageQuery{
+		generationID: query.Get("generationID"),
+		limit:        defaultLimit,
+	}
+
+	var err error
+	if fromIdx := query.Get("fromIndex"); fromIdx != "" {
+		q.fromIndex, err = strconv.ParseUint(fromIdx, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'fromIndex': %v", err)
+		}
+	}
+
+	if l := query.Get("limit"); l != "" {
+		q.limit, err = strconv.Atoi(l)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'limit': %v", err)
+		}
+		if q.limit < 0 {
+			return q, fmt.Errorf("invalid 'limit': must not be negative")
+		}
+	}
+
+	if since := query.Get("since"); since != "" {
+		q.since, err = parseTime(since)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'since': %v", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		q.until, err = parseTime(until)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'until': %v", err)
+		}
+	}
+	switch tb := query.Get("timeBasis"); tb {
+	case "", timeBasisIngestion:
+	case timeBasisEvent:
+		q.eventTime = true
+	default:
+		return q, fmt.Errorf("invalid 'timeBasis': %q", tb)
+	}
+
+	q.matchers, err = parseLabelMatchers(query["match[]"])
+	if err != nil {
+		return q, fmt.Errorf("invalid 'match[]': %v", err)
+	}
+
+	for _, fields := range query["fields"] {
+		for _, f := range strings.Split(fields, ",") {
+			p, err := parseJSONPath(strings.TrimSpace(f))
+			if err != nil {
+				return q, fmt.Errorf("invalid 'fields': %v", err)
+			}
+			q.fields = append(q.fields, p)
+		}
+	}
+	return q, nil
+}
+
+// parseTime parses a timestamp given either in RFC3339 format or as a Unix
+// timestamp in (possibly fractional) seconds.
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseAppendOptions parses the options of an append request that apply to
+// both single and batch appends: the event time given in the X-Event-Time
+// header, and the time to live given in the X-Message-TTL header or the ttl
+// query parameter.
+func parseAppendOptions(r *http.Request) (appendOptions, error) {
+	var opts appendOptions
+	if h := r.Header.Get("X-Event-Time"); h != "" {
+		t, err := parseTime(h)
+		if err != nil {
+			return opts, fmt.Errorf("invalid X-Event-Time header: %v", err)
+		}
+		if !validEventTime(t) {
+			return opts, fmt.Errorf("invalid X-Event-Time header: %v is not between 1970 and 2262", t)
+		}
+		opts.eventTime = &t
+	}
+
+	ttl := r.Header.Get("X-Message-TTL")
+	if ttl == "" {
+		ttl = r.URL.Query().Get("ttl")
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid message TTL %q: must be a positive duration", ttl)
+		}
+		opts.ttl = d
+	}
+	return opts, nil
+}
+
+// accepts reports whether the request's Accept header explicitly lists the
+// given media type.
+func accepts(r *http.Request, mediaType string) bool {
+	mediaType = strings.ToLower(strings.TrimSpace(strings.Split(mediaType, ";")[0]))
+	for _, accept := range r.Header["Accept"] {
+		for _, rng := range strings.Split(accept, ",") {
+			if strings.ToLower(strings.TrimSpace(strings.Split(rng, ";")[0])) == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeBatch decodes a batch of JSON values that is given either as a JSON
+// array or as newline-delimited JSON. Unless anyValue is set, all values must
+// be JSON objects.
+func decodeBatch(body []byte, anyValue bool) ([]interface{}, error) {
+	check := func(i int, v interface{}) error {
+		if _, ok := v.(map[string]interface{}); !ok && v != nil && !anyValue {
+			return fmt.Errorf("value %d is not a JSON object", i+1)
+		}
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var data []interface{}
+		if err := json.Unmarshal(trimmed, &data); err != nil {
+			return nil, err
+		}
+		for i, v := range data {
+			if err := check(i, v); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+
+	data := []interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %v", len(data)+1, err)
+		}
+		if err := check(len(data), v); err != nil {
+			return nil, err
+		}
+		data = append(data, v)
+	}
+}
+
+// errBodyTooLarge is returned when reading a request body that exceeds the
+// size limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads a request body of at most limit bytes. A zero limit means no
+// limit.
+func readBody(r *http.Request, limit uint64) ([]byte, error) {
+	if limit == 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// readAppendBody reads the body of an append request to a topic, limited to
+// the topic's maximum message size. It responds with an error and returns
+// false if the body can't be read.
+func readAppendBody(w http.ResponseWriter, r *http.Request, cfg *TopicConfig, opts *webOptions) ([]byte, bool) {
+	limit := opts.maxMessageBytes
+	if cfg.MaxMessageBytes > 0 {
+		limit = cfg.MaxMessageBytes
+	}
+	body, err := readBody(r, limit)
+	if err == errBodyTooLarge {
+		http.Error(w, fmt.Sprintf("request body exceeds the limit of %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return body, true
+}
+
+// appendError responds with the status code that corresponds to an error
+// returned by appending to the store.
+func appendError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTopicNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// webOptions holds the settings of the web interface.
+type webOptions struct {
+	// pushInterval is the time window during which newly appended messages
+	// are coalesced before pushing them to watching clients.
+	pushInterval time.Duration
+	// maxMessageBytes limits the size of append request bodies, unless a
+	// topic sets its own limit. 0 means no limit.
+	maxMessageBytes uint64
+	meta            metaOptions
+}
+
+func serve(addr string, store messageStore, opts *webOptions, registry *prometheus.Registry) error {
+	watchManager := newWatchManager(store, opts.pushInterval)
 	r := mux.NewRouter()
 	r.HandleFunc("/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
+		vars := mux.Vars(r)
+		cfg, err := store.topicConfig(vars["topic"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, ok := readAppendBody(w, r, cfg, opts)
+		if !ok {
+			return
+		}
+
+		appendOpts, err := parseAppendOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		appendOpts.idempotencyKey = r.Header.Get("Idempotency-Key")
+		var data interface{}
+		switch cfg.Content {
+		case contentRaw:
+			data = body
+			appendOpts.contentType = r.Header.Get("Content-Type")
+			if appendOpts.contentType == "" {
+				appendOpts.contentType = "application/octet-stream"
+			}
+		case contentJSON:
+			if err = json.Unmarshal(body, &data); err != nil {
+				http.Error(w, fmt.Sprintf("body is not valid JSON: %v", err), http.StatusBadRequest)
+				return
+			}
+		default:
+			var obj map[string]interface{}
+			if err = json.Unmarshal(body, &obj); err != nil {
+				http.Error(w, fmt.Sprintf("body is not a valid JSON object: %v", err), http.StatusBadRequest)
+				return
+			}
+			data = obj
+		}
+		appendOpts.meta = opts.meta.capture(r, data)
+
+		msgs, created, err := store.append(vars["topic"], data, appendOpts)
+		if err != nil {
+			appendError(w, err)
+			return
+		}
+
+		// Split Alertmanager notifications are stored as several messages, so
+		// sends to such topics always get the range of indexes in response.
+		var resp interface{} = AppendResponse{
+			GenerationID: store.generation(),
+			Index:        msgs[0].Index,
+			Timestamp:    msgs[0].Timestamp,
+		}
+		if cfg.Alertmanager != nil && cfg.Alertmanager.SplitAlerts {
+			resp = BatchAppendResponse{
+				GenerationID: store.generation(),
+				FirstIndex:   msgs[0].Index,
+				LastIndex:    msgs[len(msgs)-1].Index,
+			}
+		}
+		marshalled, err := json.Marshal(resp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		var data map[string]interface{}
-		if err = json.Unmarshal(body, &data); err != nil {
-			http.Error(w, fmt.Sprintf("body is not a valid JSON object: %v", err), http.StatusBadRequest)
+		location := url.URL{Path: fmt.Sprintf("/topics/%s/messages/%d", vars["topic"], msgs[0].Index)}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", location.EscapedPath())
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		if _, err := w.Write(marshalled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	}).Methods("POST")
 
+	r.HandleFunc("/topics/{topic}/batch", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if err = store.append(vars["topic"], data); err != nil {
+		cfg, err := store.topicConfig(vars["topic"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, ok := readAppendBody(w, r, cfg, opts)
+		if !ok {
+			return
+		}
+		if cfg.Content == contentRaw {
+			http.Error(w, "batches are not supported for topics with raw content", http.StatusBadRequest)
+			return
+		}
+		if cfg.Alertmanager != nil && cfg.Alertmanager.SplitAlerts {
+			http.Error(w, "batches are not supported for topics that split Alertmanager notifications", http.StatusBadRequest)
+			return
+		}
+
+		data, err := decodeBatch(body, cfg.Content == contentJSON)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("body is not a valid JSON array or sequence of JSON values: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(data) == 0 {
+			http.Error(w, "batch must contain at least one object", http.StatusBadRequest)
+			return
+		}
+
+		appendOpts, err := parseAppendOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		appendOpts.idempotencyKey = r.Header.Get("Idempotency-Key")
+		appendOpts.meta = opts.meta.capture(r, nil)
+		resp, err := store.appendBatch(vars["topic"], data, appendOpts)
+		if err != nil {
+			appendError(w, err)
+			return
+		}
+
+		marshalled, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := w.Write(marshalled); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}).Methods("POST")
 
 	r.HandleFunc("/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			http.Error(w, fmt.Sprintf("invalid method %s", r.Method), http.StatusBadRequest)
+		var cfg TopicConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, fmt.Sprintf("body is not a valid topic configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		vars := mux.Vars(r)
+		created, err := store.setTopicConfig(vars["topic"], &cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}).Methods("PUT")
 
-		genID := r.URL.Query().Get("generationID")
-		fromIdx := r.URL.Query().Get("fromIndex")
+	r.HandleFunc("/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if err := store.deleteTopic(vars["topic"]); err != nil {
+			if err == errTopicNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
 
-		if fromIdx == "" {
-			fromIdx = "0"
+	r.HandleFunc("/topics/{topic}/messages/{index:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		idx, err := strconv.ParseUint(vars["index"], 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid index: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		msg, err := store.getMessage(vars["topic"], idx)
+		if err != nil {
+			if err == errTopicNotFound || err == errMessageNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Raw payloads are returned as-is if the client asks for their
+		// content type.
+		if msg.Encoding == encodingBase64 && accepts(r, msg.ContentType) {
+			encoded, _ := msg.Data.(string)
+			raw, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid raw payload: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", msg.ContentType)
+			if _, err := w.Write(raw); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		marshalled, err := json.Marshal(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if msg.Deleted {
+			w.WriteHeader(http.StatusGone)
+		}
+		if _, err := w.Write(marshalled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}).Methods("GET")
+
+	r.HandleFunc("/topics/{topic}/messages/{index:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		idx, err := strconv.ParseUint(vars["index"], 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid index: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := store.deleteMessage(vars["topic"], idx); err != nil {
+			if err == errTopicNotFound || err == errMessageNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/topics/{topic}/alerts", func(w http.ResponseWriter, r *http.Request) {
+		if state := r.URL.Query().Get("state"); state != "" && state != "firing" {
+			http.Error(w, fmt.Sprintf("invalid 'state' %q: only firing alerts are tracked", state), http.StatusBadRequest)
+			return
+		}
+		matchers, err := parseLabelMatchers(r.URL.Query()["match[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		alerts, err := store.getAlerts(mux.Vars(r)["topic"], matchers)
+		if err != nil {
+			if err == errTopicNotFound || err == errAlertsNotTracked {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		idx, err := strconv.ParseUint(fromIdx, 10, 64)
+		marshalled, err := json.Marshal(alerts)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("invalid 'fromIndex': %v", err), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(marshalled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}).Methods("GET")
+
+	r.HandleFunc("/topics/{topic}/alerts/{fingerprint}/history", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		msgs, err := store.get(vars["topic"], genID, idx)
+		history, err := store.getAlertHistory(vars["topic"], vars["fingerprint"])
 		if err != nil {
+			if err == errTopicNotFound || err == errAlertsNotTracked || err == errAlertNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		marshalled, err := json.Marshal(history)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(marshalled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}).Methods("GET")
+
+	r.HandleFunc("/topics", func(w http.ResponseWriter, r *http.Request) {
+		topics, err := store.listTopics()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		marshalled, err := json.Marshal(topics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := w.Write(marshalled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}).Methods("GET")
+
+	r.HandleFunc("/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("invalid method %s", r.Method), http.StatusBadRequest)
+			return
+		}
+
+		q, err := parseMessageQuery(r.URL.Query(), 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var wait time.Duration
+		if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+			wait, err = time.ParseDuration(waitParam)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid 'wait': %v", err), http.StatusBadRequest)
+				return
+			}
+			if wait < 0 {
+				http.Error(w, "invalid 'wait': must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+
+		topic := mux.Vars(r)["topic"]
+		msgs, err := store.get(topic, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(msgs.Messages) == 0 && wait > 0 {
+			q.generationID, q.fromIndex = msgs.GenerationID, msgs.NextIndex
+			appended, err := watchManager.waitForMessages(topic, q, wait, r.Context().Done())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if appended != nil {
+				msgs = appended
+			}
+		}
+
 		marshalled, err := json.Marshal(msgs)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -73,8 +616,8 @@ func serve(addr string, pushInterval time.Duration, store messageStore, registry
 		}
 	}).Methods("GET")
 
-	watchManager := newWatchManager(store, pushInterval)
 	r.HandleFunc("/topics/{topic}/watch", watchManager.handleWatchRequest)
+	r.HandleFunc("/topics/{topic}/events", watchManager.handleEventsRequest).Methods("GET")
 
 	r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 